@@ -1,7 +1,50 @@
 package zfs
 
 import (
+	"errors"
 	"fmt"
+	"strings"
+)
+
+// Sentinel errors, which may be matched with errors.Is.
+var (
+	// ErrDeviceInUse is returned when creating a zpool fails because a
+	// device contains a filesystem or belongs to another pool, and force
+	// was not set.
+	ErrDeviceInUse = errors.New("device is in use")
+	// ErrFeatureUnsupported is returned when an option requires a feature
+	// which the zfs version on the host does not support.
+	ErrFeatureUnsupported = errors.New("feature not supported by zfs")
+	// ErrEncryptionMismatch is returned when a stream cannot be received
+	// because its encryption does not match the destination's, e.g. a
+	// non-raw incremental stream for a dataset that was received raw.
+	ErrEncryptionMismatch = errors.New("stream encryption does not match destination")
+	// ErrTimeout is returned when a command was killed because it did not
+	// finish in time, e.g. because it waited for interactive input.
+	ErrTimeout = errors.New("command timed out")
+	// ErrLegacyMountpoint is returned when mounting a dataset whose
+	// mountpoint is "legacy" with Mount, which zfs refuses to do.
+	ErrLegacyMountpoint = errors.New("dataset has a legacy mountpoint")
+	// ErrRawStream is returned when a stream must be recompressed on
+	// receive, but was sent raw (SendRaw), so that its blocks cannot be.
+	ErrRawStream = errors.New("raw streams cannot be recompressed")
+	// ErrCompressedStream is returned when a stream must be recompressed on
+	// receive, but was sent compressed (SendLz4), so that its blocks are
+	// stored in the compression of the source.
+	ErrCompressedStream = errors.New("compressed streams cannot be recompressed")
+	// ErrDatasetNotFound is returned when a dataset does not exist (any
+	// longer), e.g. because it was destroyed concurrently.
+	ErrDatasetNotFound = errors.New("dataset does not exist")
+	// ErrUnsupportedPlatform is returned by operations which only exist on
+	// some platforms, e.g. Jail outside of FreeBSD.
+	ErrUnsupportedPlatform = errors.New("operation not supported on this platform")
+	// ErrInvalidResumeToken is returned when resuming a send with a token
+	// which is malformed, or which zfs rejects as corrupt.
+	ErrInvalidResumeToken = errors.New("invalid resume token")
+	// SkipTree may be returned by the function passed to Walk to skip the
+	// descendants of the dataset it was called with.  It is not returned
+	// as an error by any function.
+	SkipTree = errors.New("skip this dataset tree")
 )
 
 // Error is an error which is returned when the `zfs` or `zpool` shell
@@ -10,9 +53,74 @@ type Error struct {
 	Err    error
 	Debug  string
 	Stderr string
+	// ID is the operation ID the command was logged with.
+	ID string
+	// Transport is set when the command failed because of the ssh
+	// connection rather than the command itself, see IsTransport.
+	Transport bool
 }
 
 // Error returns the string representation of an Error.
 func (e Error) Error() string {
 	return fmt.Sprintf("%s: %q => %s", e.Err, e.Debug, e.Stderr)
 }
+
+// IsTransport reports whether the command failed because the ssh connection
+// could not be established or was lost, in which case it may be retried;
+// the next command dials a fresh connection.  Otherwise the command itself
+// failed, e.g. exited with a non-zero status.
+func (e Error) IsTransport() bool {
+	return e.Transport
+}
+
+// Unwrap returns the underlying error, so that errors.Is can match the
+// sentinel errors of this package.
+func (e Error) Unwrap() error {
+	return e.Err
+}
+
+// classifyError returns a copy of err with the sentinel as underlying error
+// if err is an *Error whose stderr contains one of the given patterns.
+// Otherwise err is returned unchanged.
+func classifyError(err error, sentinel error, patterns ...string) error {
+	zerr, ok := err.(*Error)
+	if !ok {
+		return err
+	}
+	for _, pattern := range patterns {
+		if strings.Contains(zerr.Stderr, pattern) {
+			classified := *zerr
+			classified.Err = sentinel
+			return &classified
+		}
+	}
+	return err
+}
+
+// stderrContains reports whether err is an *Error whose stderr contains
+// pattern.
+func stderrContains(err error, pattern string) bool {
+	zerr, ok := err.(*Error)
+	return ok && strings.Contains(zerr.Stderr, pattern)
+}
+
+// TransferError is returned when a transfer between two handles fails.
+// ResumeToken is the receive_resume_token left on the destination when it
+// saved part of the stream, and may be used to resume the transfer.
+type TransferError struct {
+	Err         error
+	ResumeToken string
+}
+
+// Error returns the string representation of a TransferError.
+func (e *TransferError) Error() string {
+	if e.ResumeToken != "" {
+		return fmt.Sprintf("%s (resumable)", e.Err)
+	}
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *TransferError) Unwrap() error {
+	return e.Err
+}
@@ -35,3 +35,37 @@ func TestError(t *testing.T) {
 		}
 	}
 }
+
+func TestClassifyError(t *testing.T) {
+	zErr := &Error{
+		Err:    errors.New("exit status 1"),
+		Debug:  "zpool create test /dev/sdb",
+		Stderr: "/dev/sdb contains a filesystem of type 'ext4'",
+	}
+
+	err := classifyError(zErr, ErrDeviceInUse, "contains a filesystem")
+	if !errors.Is(err, ErrDeviceInUse) {
+		t.Fatalf("expected ErrDeviceInUse, got: %v", err)
+	}
+	if zErr.Err == ErrDeviceInUse {
+		t.Fatalf("classifyError must not modify the original error")
+	}
+
+	if err := classifyError(zErr, ErrDeviceInUse, "no such pool"); err != zErr {
+		t.Fatalf("unexpected classification: %v", err)
+	}
+}
+
+func TestTransferError(t *testing.T) {
+	var err error = &TransferError{
+		Err:         fmt.Errorf("receive: %w", ErrTimeout),
+		ResumeToken: "1-abc",
+	}
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("expected the underlying error to match: %v", err)
+	}
+	var transferErr *TransferError
+	if !errors.As(err, &transferErr) || transferErr.ResumeToken != "1-abc" {
+		t.Fatalf("expected the resume token to be available: %v", err)
+	}
+}
@@ -0,0 +1,33 @@
+package zfs_test
+
+import (
+	"fmt"
+	"net/http"
+
+	zfs "github.com/edillmann/go-zfs"
+)
+
+// Upload a send stream to an object store.  A failed send fails the request
+// body, so the upload is aborted rather than stored truncated.
+func ExampleZfsH_SendSnapshotReader() {
+	zh := zfs.NewLocalHandle()
+	stream := zh.SendSnapshotReader("pool/data@backup", "", zfs.SendLz4, "", nil)
+	defer stream.Close()
+
+	req, err := http.NewRequest("PUT", "https://backups.example.com/pool-data-backup", stream)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Println("upload failed:", err)
+		return
+	}
+	defer resp.Body.Close()
+	if err := stream.Close(); err != nil {
+		fmt.Println("send failed:", err)
+		return
+	}
+	fmt.Println(resp.Status)
+}
@@ -0,0 +1,77 @@
+package zfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// keyCommandTimeout bounds the key management commands, which would
+// otherwise wait forever for a passphrase that is never entered.
+const keyCommandTimeout = time.Minute
+
+// keyCommand runs a zfs key management command such as load-key.  The key
+// material is fed on stdin, which is never a terminal, so zfs cannot prompt
+// interactively.
+func (z *ZfsH) keyCommand(key []byte, arg ...string) error {
+	c := command{
+		Command: z.wrap("zfs"),
+		Stdin:   bytes.NewReader(key),
+		zh:      z,
+		timeout: keyCommandTimeout,
+	}
+	_, err := c.Run(arg...)
+	return err
+}
+
+// LoadAllKeys loads the keys of all encryption roots whose key is not
+// loaded yet, as zfs load-key -a does.  If keyFn is nil, the keys are
+// loaded from their keylocation, and roots with keylocation=prompt fail.
+// Otherwise keyFn is asked for the key of every root, and may return a nil
+// key to load it from the keylocation instead.  Loading continues past
+// failures; the errors of all roots are returned together, each of which
+// may be matched with errors.Is, e.g. against ErrTimeout.
+func (z *ZfsH) LoadAllKeys(keyFn func(dataset string) ([]byte, error)) error {
+	if keyFn == nil {
+		return z.keyCommand(nil, "load-key", "-a")
+	}
+	out, err := z.zfsTabbed("get", "-Hp", "-o", "name,property,value", "-t", "filesystem,volume",
+		"encryptionroot,keylocation,keystatus")
+	if err != nil {
+		return err
+	}
+	roots, err := parseUnavailableKeyRoots(out)
+	if err != nil {
+		return err
+	}
+
+	var failed []error
+	for _, root := range roots {
+		key, err := keyFn(root.name)
+		if err == nil {
+			switch {
+			case key != nil:
+				err = z.keyCommand(key, "load-key", "-L", "prompt", root.name)
+			case root.location == "prompt":
+				err = errors.New("keylocation=prompt requires the key to be passed")
+			default:
+				err = z.keyCommand(nil, "load-key", root.name)
+			}
+		}
+		if err != nil {
+			failed = append(failed, fmt.Errorf("%s: %w", root.name, err))
+		}
+	}
+	if failed != nil {
+		return fmt.Errorf("cannot load %d of %d keys: %w", len(failed), len(roots), errors.Join(failed...))
+	}
+	return nil
+}
+
+// UnloadAllKeys unloads the keys of all encryption roots, as zfs
+// unload-key -a does.  Datasets using them must be unmounted.
+func (z *ZfsH) UnloadAllKeys() error {
+	_, err := z.zfs("unload-key", "-a")
+	return err
+}
@@ -0,0 +1,544 @@
+package zfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SendStep is a single send operation of a replication plan.
+type SendStep struct {
+	// From is the snapshot to send incrementally from, empty for a full
+	// send.
+	From string
+	// To is the snapshot to send.
+	To          string
+	Incremental bool
+}
+
+// snapshotGuid is a snapshot name along with its guid, which identifies the
+// snapshot across pools.
+type snapshotGuid struct {
+	name string
+	guid string
+}
+
+// snapshotGuids returns the snapshots of the named dataset, oldest first.
+// A dataset which does not exist has no snapshots.
+func (z *ZfsH) snapshotGuids(name string) ([]snapshotGuid, error) {
+	out, err := z.zfs("list", "-Hp", "-t", DatasetSnapshot, "-d", "1", "-s", "createtxg", "-o", "name,guid", name)
+	if err != nil {
+		if stderrContains(err, "does not exist") {
+			return nil, nil
+		}
+		return nil, err
+	}
+	snapshots := make([]snapshotGuid, 0, len(out))
+	for _, line := range out {
+		if len(line) != 2 {
+			return nil, fmt.Errorf("Unexpected zfs list output: %q", line)
+		}
+		snapshots = append(snapshots, snapshotGuid{line[0], line[1]})
+	}
+	return snapshots, nil
+}
+
+// ReplicationPlan returns the ordered send operations which bring the
+// destination dataset up to date with the source.  The latest snapshot of
+// the destination which also exists on the source, compared by guid, is used
+// as the incremental base.  Without a common snapshot the plan starts with a
+// full send of the oldest source snapshot.  An empty plan means the
+// destination is up to date.
+//
+// Snapshots taken on the destination after the common snapshot are ignored,
+// receiving the plan then requires a forced (-F) receive.
+func (z *ZfsH) ReplicationPlan(src, dst *Dataset) ([]SendStep, error) {
+	srcSnaps, err := z.snapshotGuids(src.Name)
+	if err != nil {
+		return nil, err
+	}
+	dstSnaps, err := z.snapshotGuids(dst.Name)
+	if err != nil {
+		return nil, err
+	}
+	return planReplication(srcSnaps, dstSnaps)
+}
+
+func planReplication(src, dst []snapshotGuid) ([]SendStep, error) {
+	if len(src) == 0 {
+		return nil, errors.New("source has no snapshots")
+	}
+
+	index := make(map[string]int, len(src))
+	for i, snap := range src {
+		index[snap.guid] = i
+	}
+	base := -1
+	for i := len(dst) - 1; i >= 0 && base < 0; i-- {
+		if j, ok := index[dst[i].guid]; ok {
+			base = j
+		}
+	}
+
+	var steps []SendStep
+	if base < 0 {
+		if len(dst) > 0 {
+			return nil, errors.New("source and destination have no common snapshot")
+		}
+		steps = append(steps, SendStep{To: src[0].name})
+		base = 0
+	}
+	for i := base + 1; i < len(src); i++ {
+		steps = append(steps, SendStep{
+			From:        src[i-1].name,
+			To:          src[i].name,
+			Incremental: true,
+		})
+	}
+	return steps, nil
+}
+
+// Kinds of replication drift reported by CompareTrees.
+const (
+	// DriftSourceOnly is a dataset missing on the destination.
+	DriftSourceOnly = "source only"
+	// DriftDestinationOnly is a dataset missing on the source.
+	DriftDestinationOnly = "destination only"
+	// DriftBehind is a dataset missing the latest snapshot of the source
+	// on the destination.
+	DriftBehind = "behind"
+)
+
+// DriftEntry is a difference between a source and a destination tree found
+// by CompareTrees.
+type DriftEntry struct {
+	// Dataset is the name of the dataset relative to the roots, "" for the
+	// roots themselves, e.g. "/child".
+	Dataset string
+	// Kind is one of DriftSourceOnly, DriftDestinationOnly or DriftBehind.
+	Kind string
+	// LatestSnapshot is the latest source snapshot of a DriftBehind
+	// dataset.
+	LatestSnapshot string
+}
+
+// datasetTree is the filesystems and volumes under a root along with their
+// snapshots, oldest first, keyed by name relative to the root.
+type datasetTree map[string][]snapshotGuid
+
+// datasetTree lists the filesystems and volumes under root along with their
+// snapshots.  A root which does not exist has an empty tree.
+func (z *ZfsH) datasetTree(root string) (datasetTree, error) {
+	out, err := z.zfs("list", "-H", "-r", "-t", "filesystem,volume", "-o", "name", root)
+	if err != nil {
+		if stderrContains(err, "does not exist") {
+			return datasetTree{}, nil
+		}
+		return nil, err
+	}
+	tree := make(datasetTree, len(out))
+	for _, line := range out {
+		tree[strings.TrimPrefix(line[0], root)] = nil
+	}
+
+	out, err = z.zfs("list", "-Hp", "-r", "-t", DatasetSnapshot, "-s", "createtxg", "-o", "name,guid", root)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range out {
+		if len(line) != 2 {
+			return nil, fmt.Errorf("Unexpected zfs list output: %q", line)
+		}
+		name := strings.TrimPrefix(parentName(line[0]), root)
+		tree[name] = append(tree[name], snapshotGuid{line[0], line[1]})
+	}
+	return tree, nil
+}
+
+// CompareTrees compares the filesystems and volumes under srcRoot on src
+// with those under dstRoot on dst, e.g. to verify that a backup is
+// current.  It reports the datasets existing on only one side, and those
+// whose destination lacks the latest source snapshot, compared by guid.
+// Nothing is changed on either side.
+func CompareTrees(src, dst *ZfsH, srcRoot, dstRoot string) ([]DriftEntry, error) {
+	srcTree, err := src.datasetTree(srcRoot)
+	if err != nil {
+		return nil, err
+	}
+	dstTree, err := dst.datasetTree(dstRoot)
+	if err != nil {
+		return nil, err
+	}
+	return compareTrees(srcTree, dstTree), nil
+}
+
+// compareTrees returns the drift between src and dst, sorted by dataset.
+func compareTrees(src, dst datasetTree) []DriftEntry {
+	var drift []DriftEntry
+	for name, srcSnaps := range src {
+		dstSnaps, ok := dst[name]
+		if !ok {
+			drift = append(drift, DriftEntry{Dataset: name, Kind: DriftSourceOnly})
+			continue
+		}
+		if len(srcSnaps) == 0 {
+			continue
+		}
+		latest := srcSnaps[len(srcSnaps)-1]
+		found := false
+		for _, snap := range dstSnaps {
+			found = found || snap.guid == latest.guid
+		}
+		if !found {
+			drift = append(drift, DriftEntry{Dataset: name, Kind: DriftBehind, LatestSnapshot: latest.name})
+		}
+	}
+	for name := range dst {
+		if _, ok := src[name]; !ok {
+			drift = append(drift, DriftEntry{Dataset: name, Kind: DriftDestinationOnly})
+		}
+	}
+	sort.Slice(drift, func(i, j int) bool {
+		return drift[i].Dataset < drift[j].Dataset
+	})
+	return drift
+}
+
+// ReplicateOptions tunes ReplicateTo.
+type ReplicateOptions struct {
+	// SendFlags are passed to the send.  SendIncremental is implied when a
+	// base snapshot is given.
+	SendFlags SendFlag
+	// ReceiveProps are set on the received dataset, as in ReceiveSnapshot.
+	ReceiveProps []string
+	// ReceiveArgs are extra raw zfs receive arguments.
+	ReceiveArgs []string
+	// ReceiveFlags are applied to the receive, e.g. ReceiveNoMount.
+	ReceiveFlags ReceiveFlag
+	// Compress is run on the sending host to compress the stream (e.g.
+	// lzop), and Decompress on the receiving host (e.g. lzop -d).
+	Compress   string
+	Decompress string
+	// BufferSize is the number of bytes buffered in memory between send
+	// and receive, 0 for no buffering.
+	BufferSize int
+	// RateLimit limits the transfer to the given number of bytes per
+	// second, 0 for no limit.
+	RateLimit int64
+	// Operation, if set, follows the progress of the transfer.
+	Operation *Operation
+	// RequiredFeatures are pool features, e.g. "large_blocks", which must
+	// be enabled on the destination pool for the transfer to start.  With
+	// CheckFeatures, the features the stream requires because of SendFlags
+	// are checked too.  A missing feature is reported as
+	// ErrFeatureUnsupported, rather than failing the receive mid-stream.
+	RequiredFeatures []string
+	CheckFeatures    bool
+}
+
+// sendFlagPoolFeatures are the pool features required to receive a stream
+// sent with a flag.
+var sendFlagPoolFeatures = map[SendFlag]string{
+	SendRaw:          "encryption",
+	SendEmbeddedData: "embedded_data",
+	SendLz4:          "lz4_compress",
+}
+
+// checkPoolFeatures verifies that the pool of dstName has the features
+// required by opts and flags enabled.
+func (z *ZfsH) checkPoolFeatures(dstName string, flags SendFlag, opts ReplicateOptions) error {
+	features := append([]string(nil), opts.RequiredFeatures...)
+	if opts.CheckFeatures {
+		for flag, feature := range sendFlagPoolFeatures {
+			if flags&flag != 0 {
+				features = append(features, feature)
+			}
+		}
+	}
+	zp := &Zpool{Name: poolName(dstName)}
+	for _, feature := range features {
+		supported, err := z.PoolSupportsFeature(zp, feature)
+		if err != nil {
+			return err
+		}
+		if !supported {
+			return fmt.Errorf("%w: destination pool %s lacks feature@%s",
+				ErrFeatureUnsupported, zp.Name, strings.TrimPrefix(feature, "feature@"))
+		}
+	}
+	return nil
+}
+
+// ReplicateTo sends the snapshot srcSnap from the receiving handle and
+// receives it as dstName through the dst handle, which may be a different
+// host.  If baseSnap is set, an incremental stream from baseSnap is sent.
+// The stream flows through this process; errors of both sides are reported.
+//
+// The receive is resumable.  If the transfer fails after the receiving side
+// has saved some of the stream, the returned error is a *TransferError
+// carrying the receive_resume_token of dstName, which ResumeTo accepts to
+// continue the transfer; ResumableTransfer does so automatically.
+func (z *ZfsH) ReplicateTo(dst *ZfsH, srcSnap, baseSnap, dstName string, opts ReplicateOptions) error {
+	flags := opts.SendFlags
+	if baseSnap != "" {
+		flags |= SendIncremental
+	}
+	return z.replicate(dst, srcSnap, baseSnap, dstName, flags, opts)
+}
+
+// ResumeTo continues a transfer to dstName, interrupted with the given
+// receive_resume_token, e.g. taken from a *TransferError.  The send flags
+// are encoded in the token, so opts.SendFlags is ignored.
+func (z *ZfsH) ResumeTo(dst *ZfsH, token, dstName string, opts ReplicateOptions) error {
+	return z.replicate(dst, token, "", dstName, SendWithToken, opts)
+}
+
+// ResumableTransfer is like ReplicateTo, but retries a failed transfer up
+// to retries times.  A retry resumes from the receive_resume_token when
+// the receiving side saved part of the stream, and starts over when the
+// transfer failed because of the ssh connection, see IsTransport.  Other
+// failures, e.g. ErrFeatureUnsupported or ErrEncryptionMismatch, would
+// only happen again and are returned right away, as is the error of the
+// last attempt.
+func (z *ZfsH) ResumableTransfer(dst *ZfsH, srcSnap, baseSnap, dstName string, opts ReplicateOptions, retries int) error {
+	err := z.ReplicateTo(dst, srcSnap, baseSnap, dstName, opts)
+	for i := 0; err != nil && i < retries; i++ {
+		token, retry := retryTransfer(err)
+		switch {
+		case token != "":
+			err = z.ResumeTo(dst, token, dstName, opts)
+		case retry:
+			err = z.ReplicateTo(dst, srcSnap, baseSnap, dstName, opts)
+		default:
+			return err
+		}
+	}
+	return err
+}
+
+// retryTransfer reports whether a transfer which failed with err is worth
+// retrying, and the resume token to continue it from, if one was saved.
+func retryTransfer(err error) (string, bool) {
+	var transferErr *TransferError
+	if errors.As(err, &transferErr) && transferErr.ResumeToken != "" {
+		return transferErr.ResumeToken, true
+	}
+	return "", isTransportError(err)
+}
+
+// isTransportError reports whether err, or any error it wraps, is an
+// *Error caused by the ssh connection.  Unlike errors.As, it looks past
+// the first *Error, as a transfer error wraps those of both sides.
+func isTransportError(err error) bool {
+	switch e := err.(type) {
+	case nil:
+		return false
+	case *Error:
+		if e.IsTransport() {
+			return true
+		}
+	}
+	switch u := err.(type) {
+	case interface{ Unwrap() []error }:
+		for _, err := range u.Unwrap() {
+			if isTransportError(err) {
+				return true
+			}
+		}
+	case interface{ Unwrap() error }:
+		return isTransportError(u.Unwrap())
+	}
+	return false
+}
+
+// ResumeRecursiveReceive resumes the interrupted receive of a recursive
+// (SendRecursive) stream into dstRoot on dst, sent from the receiving
+// handle.  A receive_resume_token only covers the dataset it was left on,
+// so every dataset under dstRoot holding one is resumed, parents before
+// their children, stopping at the first failure.  Datasets the interrupted
+// stream had not reached yet are not created; run the replication again,
+// e.g. with ReplicationPlan, to bring them up to date.
+func (z *ZfsH) ResumeRecursiveReceive(dst *ZfsH, dstRoot string, opts ReplicateOptions) error {
+	datasets, err := dst.listByType("filesystem,volume", dstRoot, -1, true)
+	if err != nil {
+		return err
+	}
+	for _, ds := range partialReceivesInOrder(datasets) {
+		if err := z.ResumeTo(dst, ds.ReceiveResumeToken, ds.Name, opts); err != nil {
+			return fmt.Errorf("resuming %s: %w", ds.Name, err)
+		}
+	}
+	return nil
+}
+
+// partialReceivesInOrder returns the datasets holding a receive resume
+// token, parents before their children.
+func partialReceivesInOrder(datasets []*Dataset) []*Dataset {
+	var partial []*Dataset
+	for _, ds := range datasets {
+		if ds.ReceiveResumeToken != "" {
+			partial = append(partial, ds)
+		}
+	}
+	sort.SliceStable(partial, func(i, j int) bool {
+		return strings.Count(partial[i].Name, "/") < strings.Count(partial[j].Name, "/")
+	})
+	return partial
+}
+
+// replicate runs the send of ds0 and ds1 with flags and the receive into
+// dstName.
+func (z *ZfsH) replicate(dst *ZfsH, ds0, ds1, dstName string, flags SendFlag, opts ReplicateOptions) error {
+	if err := dst.checkPoolFeatures(dstName, flags, opts); err != nil {
+		return err
+	}
+	bufferSize := opts.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = bufferedPipeChunk
+	}
+	pipe := newBufferedPipe(bufferSize)
+	var output io.Writer = pipe
+	if opts.RateLimit > 0 {
+		output = &rateLimitedWriter{w: pipe, rate: opts.RateLimit}
+	}
+
+	sendErr := make(chan error, 1)
+	go func() {
+		sendOpts := &StreamOptions{Operation: opts.Operation}
+		err := z.SendSnapshotWithOptions(ds0, ds1, output, flags, opts.Compress, sendOpts)
+		pipe.closeWrite(err)
+		sendErr <- err
+	}()
+
+	recvOpts := &StreamOptions{ReceiveFlags: opts.ReceiveFlags}
+	_, recvErr := dst.ReceiveSnapshotWithOptions(pipe, dstName, opts.Decompress, opts.ReceiveProps, recvOpts, opts.ReceiveArgs...)
+	pipe.closeRead(recvErr)
+	err := joinTransferErrors(<-sendErr, recvErr)
+	if err == nil {
+		return nil
+	}
+	transferErr := &TransferError{Err: err}
+	if ds, dsErr := dst.GetDataset(dstName); dsErr == nil {
+		transferErr.ResumeToken = ds.ReceiveResumeToken
+	}
+	return transferErr
+}
+
+// joinTransferErrors combines the errors of the send and receive side,
+// which both remain reachable with errors.Is and errors.As.
+func joinTransferErrors(sendErr, recvErr error) error {
+	switch {
+	case sendErr != nil && recvErr != nil:
+		return fmt.Errorf("send: %w; receive: %w", sendErr, recvErr)
+	case sendErr != nil:
+		return fmt.Errorf("send: %w", sendErr)
+	case recvErr != nil:
+		return fmt.Errorf("receive: %w", recvErr)
+	}
+	return nil
+}
+
+// bufferedPipeChunk is the size of the chunks held by a bufferedPipe.
+const bufferedPipeChunk = 128 * 1024
+
+// bufferedPipe is an in-memory pipe holding up to a given number of bytes,
+// so that the sender does not have to wait for every read of the receiver.
+type bufferedPipe struct {
+	chunks   chan []byte
+	closed   chan struct{}
+	once     sync.Once
+	writeErr error
+	readErr  error
+	current  []byte
+}
+
+func newBufferedPipe(size int) *bufferedPipe {
+	n := size / bufferedPipeChunk
+	if n < 1 {
+		n = 1
+	}
+	return &bufferedPipe{
+		chunks: make(chan []byte, n),
+		closed: make(chan struct{}),
+	}
+}
+
+func (p *bufferedPipe) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := len(b)
+		if n > bufferedPipeChunk {
+			n = bufferedPipeChunk
+		}
+		chunk := make([]byte, n)
+		copy(chunk, b)
+		select {
+		case p.chunks <- chunk:
+		case <-p.closed:
+			if p.readErr != nil {
+				return written, p.readErr
+			}
+			return written, io.ErrClosedPipe
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// closeWrite ends the stream, readers get err or io.EOF once the buffered
+// data has been read.
+func (p *bufferedPipe) closeWrite(err error) {
+	p.writeErr = err
+	close(p.chunks)
+}
+
+func (p *bufferedPipe) Read(b []byte) (int, error) {
+	for len(p.current) == 0 {
+		chunk, ok := <-p.chunks
+		if !ok {
+			if p.writeErr != nil {
+				return 0, p.writeErr
+			}
+			return 0, io.EOF
+		}
+		p.current = chunk
+	}
+	n := copy(b, p.current)
+	p.current = p.current[n:]
+	return n, nil
+}
+
+// closeRead makes pending and future writes fail with err, or
+// io.ErrClosedPipe if err is nil.
+func (p *bufferedPipe) closeRead(err error) {
+	p.once.Do(func() {
+		p.readErr = err
+		close(p.closed)
+	})
+}
+
+// rateLimitedWriter throttles the writes to w to rate bytes per second.
+type rateLimitedWriter struct {
+	w       io.Writer
+	rate    int64
+	start   time.Time
+	written int64
+}
+
+func (r *rateLimitedWriter) Write(p []byte) (int, error) {
+	if r.start.IsZero() {
+		r.start = time.Now()
+	}
+	n, err := r.w.Write(p)
+	r.written += int64(n)
+	due := time.Duration(float64(r.written) / float64(r.rate) * float64(time.Second))
+	if wait := due - time.Since(r.start); wait > 0 {
+		time.Sleep(wait)
+	}
+	return n, err
+}
@@ -0,0 +1,186 @@
+package zfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPlanReplication(t *testing.T) {
+	src := []snapshotGuid{
+		{"pool/src@a", "1"},
+		{"pool/src@b", "2"},
+		{"pool/src@c", "3"},
+	}
+
+	steps, err := planReplication(src, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []SendStep{
+		{To: "pool/src@a"},
+		{From: "pool/src@a", To: "pool/src@b", Incremental: true},
+		{From: "pool/src@b", To: "pool/src@c", Incremental: true},
+	}
+	if !reflect.DeepEqual(expected, steps) {
+		t.Fatalf("unexpected full plan: %+v", steps)
+	}
+
+	steps, err = planReplication(src, []snapshotGuid{{"pool/dst@a", "1"}, {"pool/dst@b", "2"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(expected[2:], steps) {
+		t.Fatalf("unexpected incremental plan: %+v", steps)
+	}
+
+	steps, err = planReplication(src, []snapshotGuid{{"pool/dst@c", "3"}})
+	if err != nil || len(steps) != 0 {
+		t.Fatalf("expected an empty plan, got: %+v, %v", steps, err)
+	}
+
+	if _, err = planReplication(src, []snapshotGuid{{"pool/dst@x", "9"}}); err == nil {
+		t.Fatalf("expected an error without common snapshot")
+	}
+	if _, err = planReplication(nil, nil); err == nil {
+		t.Fatalf("expected an error without source snapshots")
+	}
+}
+
+func TestCompareTrees(t *testing.T) {
+	src := datasetTree{
+		"":         {{"pool/src@a", "1"}, {"pool/src@b", "2"}},
+		"/current": {{"pool/src/current@a", "3"}},
+		"/behind":  {{"pool/src/behind@a", "4"}, {"pool/src/behind@b", "5"}},
+		"/new":     nil,
+		"/empty":   nil,
+	}
+	dst := datasetTree{
+		"":         {{"backup/dst@a", "1"}, {"backup/dst@b", "2"}},
+		"/current": {{"backup/dst/current@a", "3"}},
+		"/behind":  {{"backup/dst/behind@a", "4"}},
+		"/empty":   nil,
+		"/stale":   {{"backup/dst/stale@a", "6"}},
+	}
+	expected := []DriftEntry{
+		{Dataset: "/behind", Kind: DriftBehind, LatestSnapshot: "pool/src/behind@b"},
+		{Dataset: "/new", Kind: DriftSourceOnly},
+		{Dataset: "/stale", Kind: DriftDestinationOnly},
+	}
+	if drift := compareTrees(src, dst); !reflect.DeepEqual(expected, drift) {
+		t.Fatalf("unexpected drift: %+v", drift)
+	}
+	if drift := compareTrees(src, src); len(drift) != 0 {
+		t.Fatalf("expected no drift, got: %+v", drift)
+	}
+}
+
+func TestPartialReceivesInOrder(t *testing.T) {
+	datasets := []*Dataset{
+		{Name: "backup/root/a/b", ReceiveResumeToken: "1-1-1-1"},
+		{Name: "backup/root", ReceiveResumeToken: "1-2-2-2"},
+		{Name: "backup/root/a"},
+		{Name: "backup/root/c", ReceiveResumeToken: "1-3-3-3"},
+	}
+	var names []string
+	for _, ds := range partialReceivesInOrder(datasets) {
+		names = append(names, ds.Name)
+	}
+	expected := []string{"backup/root", "backup/root/c", "backup/root/a/b"}
+	if !reflect.DeepEqual(expected, names) {
+		t.Fatalf("expected %v, got %v", expected, names)
+	}
+}
+
+func TestJoinTransferErrors(t *testing.T) {
+	sendErr := &Error{Err: ErrTimeout, Transport: true}
+	recvErr := &Error{Err: ErrEncryptionMismatch}
+
+	err := joinTransferErrors(sendErr, recvErr)
+	if !errors.Is(err, ErrTimeout) || !errors.Is(err, ErrEncryptionMismatch) {
+		t.Fatalf("expected both sides to match: %v", err)
+	}
+	var zerr *Error
+	if !errors.As(err, &zerr) || !zerr.IsTransport() {
+		t.Fatalf("expected the send error to be reachable: %v", err)
+	}
+
+	if err := joinTransferErrors(nil, recvErr); !errors.Is(err, ErrEncryptionMismatch) {
+		t.Fatalf("expected the receive error to match: %v", err)
+	}
+	if err := joinTransferErrors(sendErr, nil); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("expected the send error to match: %v", err)
+	}
+	if err := joinTransferErrors(nil, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestRetryTransfer(t *testing.T) {
+	var tests = []struct {
+		err   error
+		token string
+		retry bool
+	}{
+		// a saved resume token is always resumed from
+		{&TransferError{Err: joinTransferErrors(nil, &Error{Err: ErrEncryptionMismatch}), ResumeToken: "1-abc"}, "1-abc", true},
+		// a lost connection on either side starts over
+		{&TransferError{Err: joinTransferErrors(&Error{Err: errors.New("eof"), Transport: true}, nil)}, "", true},
+		{&TransferError{Err: joinTransferErrors(&Error{Err: errors.New("exit 1")}, &Error{Err: errors.New("eof"), Transport: true})}, "", true},
+		// failures which would happen again are not retried
+		{fmt.Errorf("%w: large_blocks", ErrFeatureUnsupported), "", false},
+		{&TransferError{Err: joinTransferErrors(nil, &Error{Err: ErrEncryptionMismatch})}, "", false},
+		{&TransferError{Err: joinTransferErrors(&Error{Err: errors.New("exit 1")}, nil)}, "", false},
+	}
+	for _, test := range tests {
+		token, retry := retryTransfer(test.err)
+		if token != test.token || retry != test.retry {
+			t.Errorf("retryTransfer(%v) = %q, %v, want %q, %v", test.err, token, retry, test.token, test.retry)
+		}
+	}
+}
+
+func TestBufferedPipe(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), bufferedPipeChunk/4)
+	pipe := newBufferedPipe(4 * bufferedPipeChunk)
+	go func() {
+		_, err := pipe.Write(data)
+		pipe.closeWrite(err)
+	}()
+	got, err := ioutil.ReadAll(pipe)
+	if err != nil || !bytes.Equal(data, got) {
+		t.Fatalf("unexpected pipe content: %d bytes, %v", len(got), err)
+	}
+
+	failed := errors.New("send failed")
+	pipe = newBufferedPipe(0)
+	pipe.closeWrite(failed)
+	if _, err := pipe.Read(make([]byte, 1)); err != failed {
+		t.Fatalf("expected the write error, got: %v", err)
+	}
+
+	pipe = newBufferedPipe(0)
+	pipe.closeRead(nil)
+	if _, err := pipe.Write(data); err != io.ErrClosedPipe {
+		t.Fatalf("expected io.ErrClosedPipe, got: %v", err)
+	}
+}
+
+func TestRateLimitedWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := &rateLimitedWriter{w: &buf, rate: 1000}
+	start := time.Now()
+	w.Write(make([]byte, 100))
+	w.Write(make([]byte, 100))
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Fatalf("writes were not throttled: %v", elapsed)
+	}
+	if buf.Len() != 200 {
+		t.Fatalf("unexpected number of bytes written: %d", buf.Len())
+	}
+}
@@ -3,10 +3,20 @@ package zfs
 import (
 	"fmt"
 	"strings"
+	"sync"
 	"golang.org/x/crypto/ssh"
 	"io/ioutil"
 )
 
+// sshLink holds the ssh connection of a handle, which is shared by all
+// commands run through it, including concurrent ones, along with the
+// capabilities detected on the host at the other end.
+type sshLink struct {
+	sync.Mutex
+	client       *ssh.Client
+	sendFeatures *SendFeatureSet
+}
+
 func (cmd *command) StartCommand() (error, *ssh.Session) {
 	var (
 		session *ssh.Session
@@ -16,14 +26,14 @@ func (cmd *command) StartCommand() (error, *ssh.Session) {
 	z := cmd.zh
 
 	// open ssh link
-	if (z.client == nil) {
-		if err = z.dialSSH(); err != nil {
-			return err, nil
-		}
+	client, err := z.sshClient()
+	if err != nil {
+		return err, nil
 	}
 
-	// establish ssh session
-	if session, err = z.client.NewSession(); err != nil {
+	// establish ssh session, a failure means the connection is broken
+	if session, err = client.NewSession(); err != nil {
+		z.dropSSHClient(client)
 		return err, nil
 	}
 
@@ -62,11 +72,7 @@ func prepareCommand(session *ssh.Session, cmd *command) error {
 		session.Stdin = cmd.Stdin
 
 	}
-	if cmd.Stderr == nil {
-		session.Stderr = &cmd.stderr
-	} else {
-		session.Stderr = cmd.Stderr
-	}
+	session.Stderr = cmd.stderrWriter()
 	return nil
 }
 
@@ -82,6 +88,41 @@ func getKeyFile(keyfile string) (key ssh.Signer, err error) {
 	return
 }
 
+// sshClient returns the ssh client of the handle, dialing it on first use.
+func (z *ZfsH) sshClient() (*ssh.Client, error) {
+	z.link.Lock()
+	defer z.link.Unlock()
+	if z.link.client == nil {
+		if err := z.dialSSH(); err != nil {
+			return nil, err
+		}
+	}
+	return z.link.client, nil
+}
+
+// dropSSHClient closes client and makes the next command dial a new
+// connection, unless it was replaced already.
+func (z *ZfsH) dropSSHClient(client *ssh.Client) {
+	z.link.Lock()
+	defer z.link.Unlock()
+	if z.link.client == client {
+		z.link.client = nil
+	}
+	client.Close()
+}
+
+// resetSSHClient closes the ssh connection, if any, so that the next
+// command dials a new one.
+func (z *ZfsH) resetSSHClient() {
+	z.link.Lock()
+	defer z.link.Unlock()
+	if z.link.client != nil {
+		z.link.client.Close()
+		z.link.client = nil
+	}
+}
+
+// dialSSH opens the ssh connection, the caller must hold the link lock.
 func (z *ZfsH) dialSSH() error {
 
 	// keyfile authentifcation
@@ -90,6 +131,7 @@ func (z *ZfsH) dialSSH() error {
 		panic(err)
 	}
 	sshConfig := &ssh.ClientConfig{
+		Config: z.SSHConfig,
 		User: z.username,
 		Auth: []ssh.AuthMethod{
 			ssh.PublicKeys(key),
@@ -101,7 +143,7 @@ func (z *ZfsH) dialSSH() error {
 		sshConfig.Auth = append(sshConfig.Auth, ssh.Password(z.password))
 	}
 
-	z.client, err = ssh.Dial("tcp", fmt.Sprintf("%s:%d", z.host, z.port), sshConfig)
+	z.link.client, err = ssh.Dial("tcp", fmt.Sprintf("%s:%d", z.host, z.port), sshConfig)
 	if err != nil {
 		return fmt.Errorf("Failed to dial: %s", err)
 	}
@@ -0,0 +1,605 @@
+package zfs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Constants of the zfs send stream format.
+const (
+	drrBegin          = 0
+	dmuBackupMagic    = 0x2F5bacbac
+	featureFlagsMask  = 1<<30 - 1
+	featureCompressed = 1 << 22
+	featureRaw        = 1 << 24
+	dmuOstZfs         = 2
+	dmuOstZvol        = 3
+	streamHeaderSize  = 312
+)
+
+// streamHeader is the begin record of a zfs send stream.
+type streamHeader struct {
+	features uint64
+	toGuid   uint64
+	fromGuid uint64
+	toName   string
+}
+
+// raw reports whether the stream was produced by a raw send.
+func (h *streamHeader) raw() bool {
+	return h.features&featureRaw != 0
+}
+
+// compressed reports whether the stream was sent compressed (-c).
+func (h *streamHeader) compressed() bool {
+	return h.features&featureCompressed != 0
+}
+
+// peekStreamHeader decodes the begin record of the zfs send stream read from
+// r.  The returned reader yields the whole stream, including the header, and
+// must be used in place of r.
+func peekStreamHeader(r io.Reader) (*streamHeader, io.Reader, error) {
+	br := bufio.NewReaderSize(r, 4096)
+	buf, err := br.Peek(streamHeaderSize)
+	if err != nil {
+		return nil, br, err
+	}
+	header := parseStreamHeader(buf)
+	if header == nil {
+		return nil, br, errors.New("not a zfs send stream")
+	}
+	return header, br, nil
+}
+
+// byteOrder returns the byte order the stream header was written in, or nil
+// if buf does not start with a begin record.
+func byteOrder(buf []byte) binary.ByteOrder {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		if order.Uint32(buf[0:]) == drrBegin && order.Uint64(buf[8:]) == dmuBackupMagic {
+			return order
+		}
+	}
+	return nil
+}
+
+// example layout of the begin record
+//
+//	uint32 drr_type, drr_payloadlen
+//	uint64 drr_magic, drr_versioninfo, drr_creation_time
+//	uint32 drr_type, drr_flags
+//	uint64 drr_toguid, drr_fromguid
+//	char   drr_toname[256]
+func parseStreamHeader(buf []byte) *streamHeader {
+	order := byteOrder(buf)
+	if order == nil {
+		return nil
+	}
+	name := buf[56:streamHeaderSize]
+	if i := bytes.IndexByte(name, 0); i >= 0 {
+		name = name[:i]
+	}
+	return &streamHeader{
+		features: (order.Uint64(buf[16:]) >> 2) & featureFlagsMask,
+		toGuid:   order.Uint64(buf[40:]),
+		fromGuid: order.Uint64(buf[48:]),
+		toName:   string(name),
+	}
+}
+
+// StreamInfo describes a zfs send stream, as decoded by ValidateStream.
+type StreamInfo struct {
+	// ToName is the snapshot the stream was sent from, e.g. pool/fs@snap.
+	ToName string
+	ToGuid uint64
+	// FromGuid is the guid of the base snapshot of an incremental stream,
+	// or 0 for a full stream.
+	FromGuid uint64
+	// Type is DatasetFilesystem or DatasetVolume.
+	Type string
+	// Features are the stream feature flags.
+	Features   uint64
+	Compressed bool
+	Raw        bool
+}
+
+// Incremental reports whether the stream is an incremental stream.
+func (i *StreamInfo) Incremental() bool {
+	return i.FromGuid != 0
+}
+
+// ValidateStream reads a whole zfs send stream through zstreamdump, which
+// verifies its structure and checksums, and returns the description of its
+// first (or only) begin record.  The stream is consumed, so this is meant
+// for sources which can be read again for the receive, such as files.
+func (z *ZfsH) ValidateStream(input io.Reader) (*StreamInfo, error) {
+	var stdout bytes.Buffer
+	c := command{
+		Command: z.wrap("zstreamdump"),
+		Stdin:   input,
+		Stdout:  &stdout,
+		zh:      z,
+	}
+	if _, err := c.Run(); err != nil {
+		return nil, err
+	}
+	return parseStreamDump(stdout.String())
+}
+
+// example input
+// BEGIN record
+//
+//	hdrtype = 1
+//	features = 4
+//	magic = 2f5bacbac
+//	creation_time = 5c3a1b2e
+//	type = 2
+//	flags = 0x4
+//	toguid = 2e6b6b7a1d2c3e4f
+//	fromguid = 0
+//	toname = pool/fs@snap
+//
+// END checksum = 1a/2b/3c/4d
+func parseStreamDump(out string) (*StreamInfo, error) {
+	var info *StreamInfo
+	ended := false
+	for _, line := range strings.Split(out, "\n") {
+		if info == nil {
+			if strings.HasPrefix(line, "BEGIN record") {
+				info = &StreamInfo{}
+			}
+			continue
+		}
+		if strings.HasPrefix(line, "END checksum") {
+			ended = true
+			break
+		}
+		kv := strings.SplitN(strings.TrimSpace(line), " = ", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		var err error
+		switch kv[0] {
+		case "features":
+			info.Features, err = strconv.ParseUint(kv[1], 16, 64)
+		case "type":
+			switch kv[1] {
+			case strconv.Itoa(dmuOstZfs):
+				info.Type = DatasetFilesystem
+			case strconv.Itoa(dmuOstZvol):
+				info.Type = DatasetVolume
+			}
+		case "toguid":
+			info.ToGuid, err = strconv.ParseUint(kv[1], 16, 64)
+		case "fromguid":
+			info.FromGuid, err = strconv.ParseUint(kv[1], 16, 64)
+		case "toname":
+			info.ToName = kv[1]
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse %s: %v", kv[0], err)
+		}
+	}
+	if info == nil {
+		return nil, errors.New("not a zfs send stream")
+	}
+	if !ended {
+		return nil, errors.New("truncated zfs send stream")
+	}
+	info.Compressed = info.Features&featureCompressed != 0
+	info.Raw = info.Features&featureRaw != 0
+	return info, nil
+}
+
+// ReceiveWithCompression receives a ZFS stream like ReceiveSnapshot, setting
+// the compression property of the received dataset, so that its data is
+// recompressed with the given algorithm, e.g. to zstd for lz4 sources.  The
+// stream must be an uncompressed zfs send stream, as the blocks of raw and
+// compressed streams are stored as is; ErrRawStream or ErrCompressedStream
+// is returned for those.
+func (z *ZfsH) ReceiveWithCompression(input io.Reader, name, compression string, props []string) (*Dataset, error) {
+	if compression == "" || strings.ContainsAny(compression, "= ") {
+		return nil, fmt.Errorf("invalid compression %q", compression)
+	}
+	header, input, err := peekStreamHeader(input)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read stream header: %v", err)
+	}
+	if header.raw() {
+		return nil, fmt.Errorf("%w: %s", ErrRawStream, header.toName)
+	}
+	if header.compressed() {
+		return nil, fmt.Errorf("%w: %s", ErrCompressedStream, header.toName)
+	}
+	props = append(props[:len(props):len(props)], "compression="+compression)
+	return z.ReceiveSnapshot(input, name, "", props)
+}
+
+// receiveEncryptionArgs inspects the stream to be received into name, and
+// returns the zfs receive arguments needed for the encryption of the
+// destination along with the reader to receive from.  Streams which cannot
+// be decoded are passed on to zfs untouched.  remapped is set when receiving
+// with -d or -e, which make name the parent of the destination.
+func (z *ZfsH) receiveEncryptionArgs(input io.Reader, name string, remapped bool) ([]string, io.Reader) {
+	header, input, err := peekStreamHeader(input)
+	if err != nil {
+		return nil, input
+	}
+	return encryptionReceiveArgs(header.raw(), name, remapped, z.encryptionOf), input
+}
+
+// encryptionOf returns the encryption property of the named dataset, or ""
+// if it cannot be read, e.g. because zfs does not support encryption.
+func (z *ZfsH) encryptionOf(name string) string {
+	out, err := z.zfsTabbed("get", "-Hp", "-o", "value", "encryption", name)
+	if err != nil || len(out) != 1 {
+		return ""
+	}
+	return out[0][0]
+}
+
+// encryptionReceiveArgs returns the zfs receive arguments needed to receive a
+// raw or non-raw stream into name, or below it if remapped, looking up the
+// encryption of datasets with encryptionOf.  A non-raw stream received below
+// an encrypted parent inherits the parent's encryption; everything else is
+// left to zfs, whose refusals are reported as ErrEncryptionMismatch.
+func encryptionReceiveArgs(raw bool, name string, remapped bool, encryptionOf func(name string) string) []string {
+	if raw {
+		return nil
+	}
+	parent := name
+	if !remapped {
+		parent = parentName(strings.SplitN(name, "@", 2)[0])
+	}
+	if parent == "" {
+		return nil
+	}
+	if encryption := encryptionOf(parent); encryption != "" && encryption != "off" && encryption != "-" {
+		// let the new dataset inherit the encryption of its parent
+		return []string{"-x", "encryption"}
+	}
+	return nil
+}
+
+// encryptionMismatchPatterns are the zfs receive complaints about a stream
+// whose encryption does not match the destination's.
+var encryptionMismatchPatterns = []string{
+	"on top of existing unencrypted dataset",
+	"overwrite an unencrypted one with an encrypted one",
+	"encryption key does not match",
+	"inherited key must be loaded",
+	"IV set guid mismatch",
+}
+
+// StderrTail is an io.Writer retaining the last lines written to it, meant
+// to be used as StreamOptions.Stderr to show the warnings of a running send
+// or receive.  It may be read while being written to.
+type StderrTail struct {
+	// OnLine, if set, is called with every complete line as it is written.
+	OnLine func(line string)
+
+	mu      sync.Mutex
+	max     int
+	lines   []string
+	partial []byte
+}
+
+// NewStderrTail returns a StderrTail retaining the last n lines.
+func NewStderrTail(n int) *StderrTail {
+	if n < 1 {
+		n = 1
+	}
+	return &StderrTail{max: n}
+}
+
+func (t *StderrTail) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	t.partial = append(t.partial, p...)
+	var complete []string
+	for {
+		i := bytes.IndexByte(t.partial, '\n')
+		if i < 0 {
+			break
+		}
+		line := strings.TrimSuffix(string(t.partial[:i]), "\r")
+		t.partial = t.partial[i+1:]
+		complete = append(complete, line)
+		t.lines = append(t.lines, line)
+		if len(t.lines) > t.max {
+			t.lines = t.lines[len(t.lines)-t.max:]
+		}
+	}
+	onLine := t.OnLine
+	t.mu.Unlock()
+
+	if onLine != nil {
+		for _, line := range complete {
+			onLine(line)
+		}
+	}
+	return len(p), nil
+}
+
+// LastStderrLines returns the last complete lines written, oldest first.
+func (t *StderrTail) LastStderrLines() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]string(nil), t.lines...)
+}
+
+// CountingWriter is an io.Writer counting the bytes written through it.
+// The count may be read while writing.
+type CountingWriter struct {
+	w io.Writer
+	n uint64
+}
+
+// NewCountingWriter returns a CountingWriter writing to w.
+func NewCountingWriter(w io.Writer) *CountingWriter {
+	return &CountingWriter{w: w}
+}
+
+func (c *CountingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	atomic.AddUint64(&c.n, uint64(n))
+	return n, err
+}
+
+// BytesTransferred returns the number of bytes written so far.
+func (c *CountingWriter) BytesTransferred() uint64 {
+	return atomic.LoadUint64(&c.n)
+}
+
+// CountingReader is an io.Reader counting the bytes read through it.  The
+// count may be read while reading.
+type CountingReader struct {
+	r io.Reader
+	n uint64
+}
+
+// NewCountingReader returns a CountingReader reading from r.
+func NewCountingReader(r io.Reader) *CountingReader {
+	return &CountingReader{r: r}
+}
+
+func (c *CountingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddUint64(&c.n, uint64(n))
+	return n, err
+}
+
+// BytesTransferred returns the number of bytes read so far.
+func (c *CountingReader) BytesTransferred() uint64 {
+	return atomic.LoadUint64(&c.n)
+}
+
+// Operation is a handle on a send or receive, passed in StreamOptions to
+// follow it from another goroutine.  The zero value is ready to use, and a
+// handle must not be shared by several operations.
+type Operation struct {
+	mu      sync.Mutex
+	counter interface{ BytesTransferred() uint64 }
+}
+
+// BytesTransferred returns the number of stream bytes that went through
+// this process so far, as written by a send to its output or read by a
+// receive from its input, after any compression.  It does not depend on
+// the progress reporting of the zfs version.
+func (o *Operation) BytesTransferred() uint64 {
+	o.mu.Lock()
+	counter := o.counter
+	o.mu.Unlock()
+	if counter == nil {
+		return 0
+	}
+	return counter.BytesTransferred()
+}
+
+// countWriter makes the operation count the bytes written to w, if o is
+// not nil, and returns the writer to use in place of w.
+func (o *Operation) countWriter(w io.Writer) io.Writer {
+	if o == nil {
+		return w
+	}
+	cw := NewCountingWriter(w)
+	o.mu.Lock()
+	o.counter = cw
+	o.mu.Unlock()
+	return cw
+}
+
+// countReader makes the operation count the bytes read from r, if o is not
+// nil, and returns the reader to use in place of r.
+func (o *Operation) countReader(r io.Reader) io.Reader {
+	if o == nil {
+		return r
+	}
+	cr := NewCountingReader(r)
+	o.mu.Lock()
+	o.counter = cr
+	o.mu.Unlock()
+	return cr
+}
+
+// SendSnapshotReader returns a reader of the zfs send stream SendSnapshot
+// would write for the same arguments, e.g. to be used as the body of an
+// upload.  The send runs as the stream is read.
+//
+// The reader returns io.EOF only once the send completed successfully.  A
+// failed send, including a failure to start it, is returned by the Read
+// which would have returned io.EOF, so that a truncated stream is never
+// mistaken for a complete one.  Close returns the error of the send if it
+// finished, and otherwise kills it and returns nil.
+func (z *ZfsH) SendSnapshotReader(ds0, ds1 string, sendflags SendFlag, compress string, opts *StreamOptions, extra ...string) io.ReadCloser {
+	pr, pw := io.Pipe()
+	r := &sendReader{
+		PipeReader: pr,
+		cancel:     make(chan struct{}),
+		done:       make(chan error, 1),
+	}
+	go func() {
+		err := z.send(ds0, ds1, pw, sendflags, compress, opts, r.cancel, extra)
+		pw.CloseWithError(err)
+		r.done <- err
+	}()
+	return r
+}
+
+// sendReader is the reading end of a send run by SendSnapshotReader.
+type sendReader struct {
+	*io.PipeReader
+	cancel chan struct{}
+	done   chan error
+	once   sync.Once
+	err    error
+}
+
+func (r *sendReader) Close() error {
+	r.once.Do(func() {
+		select {
+		case r.err = <-r.done:
+		default:
+			close(r.cancel)
+			r.PipeReader.Close()
+			<-r.done
+		}
+	})
+	return r.err
+}
+
+// CancellableReceive is a receive started by ReceiveSnapshotCancellable.
+type CancellableReceive struct {
+	zh      *ZfsH
+	name    string
+	input   io.Reader
+	pw      *io.PipeWriter
+	once    sync.Once
+	stopped int32
+	done    chan struct{}
+	ds      *Dataset
+	err     error
+}
+
+// ReceiveSnapshotCancellable starts receiving a ZFS stream like
+// ReceiveSnapshotWithOptions, and returns at once.  The receive may be
+// stopped cleanly with Stop, e.g. on shutdown, leaving the partially
+// received state and a receive_resume_token to resume the transfer with
+// later, as receives are always resumable (-s).  This differs from
+// AbortReceive, which discards the partial state.
+//
+// input is read by a goroutine until it ends.  If input is an io.Closer,
+// Stop closes it, so that a stalled source cannot block the goroutine;
+// otherwise the caller must close the source after Stop.
+func (z *ZfsH) ReceiveSnapshotCancellable(input io.Reader, name, uncompress string, props []string, opts *StreamOptions, extra ...string) *CancellableReceive {
+	pr, pw := io.Pipe()
+	r := &CancellableReceive{zh: z, name: name, input: input, pw: pw, done: make(chan struct{})}
+	go func() {
+		_, err := io.Copy(pw, input)
+		pw.CloseWithError(err)
+	}()
+	go func() {
+		r.ds, r.err = z.ReceiveSnapshotWithOptions(pr, name, uncompress, props, opts, extra...)
+		pr.Close()
+		close(r.done)
+	}()
+	return r
+}
+
+// Wait waits for the receive to finish and returns the received dataset.
+func (r *CancellableReceive) Wait() (*Dataset, error) {
+	<-r.done
+	return r.ds, r.err
+}
+
+// Stop ends the stream of the receive as if the sender had been
+// interrupted, waits for zfs receive to save the partially received state
+// and returns the receive_resume_token left.  zfs handles the truncated
+// stream cleanly, which a killed receive may not.  If the receive finished
+// before it could be stopped, the token is empty and the error is that of
+// the receive, nil if it succeeded.  If no token was left, the error of
+// the interrupted receive is returned.  The input is closed if it is an
+// io.Closer, see ReceiveSnapshotCancellable.
+func (r *CancellableReceive) Stop() (string, error) {
+	r.once.Do(func() {
+		select {
+		case <-r.done:
+		default:
+			atomic.StoreInt32(&r.stopped, 1)
+			r.pw.Close()
+		}
+		if closer, ok := r.input.(io.Closer); ok {
+			closer.Close()
+		}
+	})
+	<-r.done
+	if r.err == nil || atomic.LoadInt32(&r.stopped) == 0 {
+		return "", r.err
+	}
+	ds, err := r.zh.GetDataset(r.name)
+	if err != nil || ds.ReceiveResumeToken == "" {
+		return "", r.err
+	}
+	return ds.ReceiveResumeToken, nil
+}
+
+// SendSnapshotToConn sends a ZFS stream like SendSnapshot directly to conn,
+// e.g. a TCP connection to ReceiveSnapshotFromConn on a trusted network,
+// without the overhead of ssh.  If writing to conn fails, the send is
+// killed and the error of the connection returned.  After a successful
+// send the writing side of conn is closed when it supports it, as
+// *net.TCPConn does, so that the receiver sees the end of the stream; conn
+// itself is left to the caller to close.
+func (z *ZfsH) SendSnapshotToConn(ds0, ds1 string, flags SendFlag, conn net.Conn) error {
+	w := &connWriter{conn: conn, cancel: make(chan struct{})}
+	err := z.send(ds0, ds1, w, flags, "", nil, w.cancel, nil)
+	if w.err != nil {
+		return fmt.Errorf("connection: %v", w.err)
+	}
+	if err != nil {
+		return err
+	}
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// ReceiveSnapshotFromConn receives a ZFS stream sent by SendSnapshotToConn
+// from conn like ReceiveSnapshot.  If the connection fails, the stream ends
+// and the resumable receive keeps the partially received state.
+func (z *ZfsH) ReceiveSnapshotFromConn(conn net.Conn, name string, props []string) (*Dataset, error) {
+	return z.ReceiveSnapshotWithOptions(conn, name, "", props, nil)
+}
+
+// connWriter writes to a connection, closing cancel on the first error so
+// that the command writing to it is killed.
+type connWriter struct {
+	conn   net.Conn
+	cancel chan struct{}
+	err    error
+}
+
+func (w *connWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	written := 0
+	for written < len(p) {
+		n, err := w.conn.Write(p[written:])
+		written += n
+		if err != nil {
+			w.err = err
+			close(w.cancel)
+			return written, err
+		}
+	}
+	return written, nil
+}
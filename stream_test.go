@@ -0,0 +1,183 @@
+package zfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+func testStreamHeader(order binary.ByteOrder, features uint64, toName string) []byte {
+	buf := make([]byte, streamHeaderSize+16)
+	order.PutUint32(buf[0:], drrBegin)
+	order.PutUint64(buf[8:], dmuBackupMagic)
+	order.PutUint64(buf[16:], features<<2|1)
+	order.PutUint64(buf[40:], 42)
+	order.PutUint64(buf[48:], 7)
+	copy(buf[56:], toName)
+	return buf
+}
+
+func TestPeekStreamHeader(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		stream := testStreamHeader(order, featureRaw, "pool/fs@snap")
+		header, r, err := peekStreamHeader(bytes.NewReader(stream))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !header.raw() || header.toGuid != 42 || header.fromGuid != 7 || header.toName != "pool/fs@snap" {
+			t.Fatalf("unexpected header: %+v", header)
+		}
+		data, _ := ioutil.ReadAll(r)
+		if !bytes.Equal(data, stream) {
+			t.Fatalf("stream was not passed on unchanged")
+		}
+	}
+
+	if _, _, err := peekStreamHeader(bytes.NewReader(make([]byte, streamHeaderSize))); err == nil {
+		t.Fatalf("expected an error for an invalid stream")
+	}
+}
+
+func TestReceiveWithCompressionRejects(t *testing.T) {
+	zh := NewLocalHandle()
+	for features, sentinel := range map[uint64]error{featureRaw: ErrRawStream, featureCompressed: ErrCompressedStream} {
+		stream := testStreamHeader(binary.LittleEndian, features, "pool/fs@snap")
+		_, err := zh.ReceiveWithCompression(bytes.NewReader(stream), "pool/dst", "gzip", nil)
+		if !errors.Is(err, sentinel) {
+			t.Fatalf("expected %v, got: %v", sentinel, err)
+		}
+	}
+}
+
+func TestEncryptionReceiveArgs(t *testing.T) {
+	encryption := map[string]string{"pool": "off", "pool/enc": "aes-256-gcm"}
+	encryptionOf := func(name string) string { return encryption[name] }
+	var tests = []struct {
+		raw      bool
+		name     string
+		remapped bool
+		args     int
+	}{
+		// new dataset below an unencrypted parent
+		{false, "pool/dst", false, 0},
+		// new dataset inheriting the encryption of its parent
+		{false, "pool/enc/dst", false, 2},
+		{false, "pool/enc/dst@snap", false, 2},
+		// raw stream keeping its own encryption
+		{true, "pool/enc/dst", false, 0},
+		// pool root without a parent
+		{false, "pool", false, 0},
+		// parent which cannot be looked up
+		{false, "other/dst", false, 0},
+		// -d or -e, receiving below the encrypted name itself
+		{false, "pool/enc", true, 2},
+		{true, "pool/enc", true, 0},
+		{false, "pool", true, 0},
+	}
+
+	for _, test := range tests {
+		args := encryptionReceiveArgs(test.raw, test.name, test.remapped, encryptionOf)
+		if len(args) != test.args {
+			t.Fatalf("unexpected result for %+v: %v", test, args)
+		}
+	}
+}
+
+func TestParseStreamDump(t *testing.T) {
+	info, err := parseStreamDump("BEGIN record\n" +
+		"\thdrtype = 1\n\tfeatures = 400004\n\tmagic = 2f5bacbac\n" +
+		"\tcreation_time = 5c3a1b2e\n\ttype = 2\n\tflags = 0x4\n" +
+		"\ttoguid = 2e6b6b7a1d2c3e4f\n\tfromguid = 1f\n\ttoname = pool/fs@snap\n" +
+		"END checksum = 1a/2b/3c/4d\nSUMMARY:\n\tTotal DRR_BEGIN records = 1\n")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	exp := StreamInfo{
+		ToName:     "pool/fs@snap",
+		ToGuid:     0x2e6b6b7a1d2c3e4f,
+		FromGuid:   0x1f,
+		Type:       DatasetFilesystem,
+		Features:   0x400004,
+		Compressed: true,
+	}
+	if *info != exp || !info.Incremental() {
+		t.Fatalf("unexpected info: %+v", info)
+	}
+
+	if _, err := parseStreamDump("BEGIN record\n\ttype = 2\n"); err == nil {
+		t.Fatalf("expected an error for a truncated stream")
+	}
+	if _, err := parseStreamDump(""); err == nil {
+		t.Fatalf("expected an error for an empty stream")
+	}
+}
+
+func TestStderrTail(t *testing.T) {
+	var seen []string
+	tail := NewStderrTail(2)
+	tail.OnLine = func(line string) {
+		seen = append(seen, line)
+	}
+	tail.Write([]byte("warning: one\nwarning: t"))
+	tail.Write([]byte("wo\r\nwarning: three\npartial"))
+
+	lines := tail.LastStderrLines()
+	if len(lines) != 2 || lines[0] != "warning: two" || lines[1] != "warning: three" {
+		t.Fatalf("unexpected lines: %q", lines)
+	}
+	if len(seen) != 3 || seen[0] != "warning: one" {
+		t.Fatalf("unexpected callbacks: %q", seen)
+	}
+}
+
+func TestOperationBytesTransferred(t *testing.T) {
+	var op *Operation
+	if w := op.countWriter(ioutil.Discard); w != ioutil.Discard {
+		t.Fatalf("expected no counting without an operation")
+	}
+
+	op = &Operation{}
+	if op.BytesTransferred() != 0 {
+		t.Fatalf("expected no bytes before the operation started")
+	}
+	w := op.countWriter(ioutil.Discard)
+	w.Write([]byte("abc"))
+	w.Write([]byte("de"))
+	if n := op.BytesTransferred(); n != 5 {
+		t.Fatalf("unexpected count: %d", n)
+	}
+
+	op = &Operation{}
+	r := op.countReader(strings.NewReader("abcdef"))
+	ioutil.ReadAll(r)
+	if n := op.BytesTransferred(); n != 6 {
+		t.Fatalf("unexpected count: %d", n)
+	}
+}
+
+func TestConnWriter(t *testing.T) {
+	client, server := net.Pipe()
+	w := &connWriter{conn: client, cancel: make(chan struct{})}
+	go io.Copy(ioutil.Discard, server)
+	if n, err := w.Write([]byte("stream")); n != 6 || err != nil {
+		t.Fatalf("unexpected write: %d, %v", n, err)
+	}
+
+	server.Close()
+	if _, err := w.Write([]byte("stream")); err == nil {
+		t.Fatalf("expected an error on a closed connection")
+	}
+	select {
+	case <-w.cancel:
+	default:
+		t.Fatalf("expected the command to be cancelled")
+	}
+	if _, err := w.Write([]byte("stream")); err != w.err {
+		t.Fatalf("expected the first error again, got: %v", err)
+	}
+}
@@ -1,14 +1,21 @@
 package zfs
 
 import (
+	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"os/exec"
+	"path"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 	"github.com/pborman/uuid"
 	"bytes"
 	"golang.org/x/crypto/ssh"
@@ -23,7 +30,55 @@ type command struct {
 	Stdout io.Writer
 	Stderr io.Writer
 	stdout bytes.Buffer
-	stderr bytes.Buffer
+	stderr tailBuffer
+	// timeout kills the command if it has not finished in time, when set.
+	timeout time.Duration
+	// cancel kills the command when closed, when set.
+	cancel <-chan struct{}
+}
+
+// stderrTailSize is the default amount of stderr kept for error reporting,
+// see ZfsH.MaxStderrCapture.
+const stderrTailSize = 64 * 1024
+
+// tailBuffer is an io.Writer keeping the last max bytes written to it, or
+// everything if max is 0.
+type tailBuffer struct {
+	max int
+	buf []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if t.max > 0 && len(t.buf) > t.max {
+		t.buf = append(t.buf[:0], t.buf[len(t.buf)-t.max:]...)
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string {
+	return string(t.buf)
+}
+
+// stderrWriter returns the writer for the command's stderr, which always
+// captures the tail of it for error reporting.
+func (cmd *command) stderrWriter() io.Writer {
+	cmd.stderr.max = cmd.zh.stderrCapture()
+	if cmd.Stderr == nil {
+		return &cmd.stderr
+	}
+	return io.MultiWriter(cmd.Stderr, &cmd.stderr)
+}
+
+// containsPipe reports whether the arguments pipe the output into another
+// command, as SendSnapshot does for compression.
+func containsPipe(arg []string) bool {
+	for _, a := range arg {
+		if a == "|" {
+			return true
+		}
+	}
+	return false
 }
 
 type waitable interface {
@@ -34,12 +89,15 @@ func (cmd *command) LocalPrepare(arg ...string) (*exec.Cmd) {
 
 	var lcmd *exec.Cmd
 
-	if (strings.Contains(cmd.Command,"|")) {
-		// simple command piping
+	if (strings.Contains(cmd.Command,"|") || containsPipe(arg)) {
+		// simple command piping, any sudo prefix is already part of the
+		// zfs invocation within the pipeline
 		c := strings.Join(arg," ")
-		lcmd = exec.Command("sh", "-c", cmd.Command+" "+c)
+		lcmd = exec.CommandContext(cmd.zh.context(), "sh", "-c", cmd.Command+" "+c)
 	} else {
-		lcmd = exec.Command(cmd.Command, arg...)
+		// the command may carry a prefix such as "sudo -n zfs"
+		parts := strings.Fields(cmd.Command)
+		lcmd = exec.CommandContext(cmd.zh.context(), parts[0], append(parts[1:], arg...)...)
 	}
 
 	if cmd.Stdout == nil {
@@ -52,31 +110,126 @@ func (cmd *command) LocalPrepare(arg ...string) (*exec.Cmd) {
 		lcmd.Stdin = cmd.Stdin
 
 	}
-	if cmd.Stderr == nil {
-		lcmd.Stderr = &cmd.stderr
-	} else {
-		lcmd.Stderr = cmd.Stderr
-	}
+	lcmd.Stderr = cmd.stderrWriter()
 	return lcmd
 }
 
+// readSubcommands are the zfs and zpool subcommands which do not change
+// anything, and may thus be retried.
+var readSubcommands = map[string]map[string]bool{
+	"zfs":   {"list": true, "get": true, "holds": true, "diff": true},
+	"zpool": {"list": true, "get": true, "status": true},
+}
+
+// retryable reports whether the command only reads, and neither consumes
+// input nor streams output, so that it can safely be run again.
+func (c *command) retryable(arg []string) bool {
+	if c.zh.Local || c.Stdin != nil || c.Stdout != nil || len(arg) == 0 ||
+		strings.Contains(c.Command, "|") || containsPipe(arg) {
+		return false
+	}
+	parts := strings.Fields(c.Command)
+	return readSubcommands[path.Base(parts[len(parts)-1])][arg[0]]
+}
+
+// Run runs the command.  A read-only zfs or zpool command which fails
+// because of the ssh connection is run once more on a new connection.
 func (c *command) Run(arg ...string) ([][]string, error) {
+	out, err := c.run(arg...)
+	if zerr, ok := err.(*Error); ok && zerr.Transport && c.retryable(arg) {
+		c.zh.resetSSHClient()
+		c.stdout.Reset()
+		c.stderr.buf = nil
+		return c.run(arg...)
+	}
+	return out, err
+}
+
+// scanBufferSize is the longest line RunScan accepts.
+const scanBufferSize = 1024 * 1024
+
+// RunScan runs the command like Run, but calls fn with each line of its
+// output as soon as it is written, rather than collecting the output.  The
+// command is killed when ctx is done, returning ctx.Err(), or when fn
+// returns an error, which is returned.
+func (c *command) RunScan(ctx context.Context, fn func(line string) error, arg ...string) error {
+	pr, pw := io.Pipe()
+	stop := make(chan struct{})
+	var once sync.Once
+	kill := func() {
+		once.Do(func() { close(stop) })
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			kill()
+		case <-stop:
+		}
+	}()
+
+	c.Stdout = pw
+	c.cancel = stop
+	runErr := make(chan error, 1)
+	go func() {
+		_, err := c.Run(arg...)
+		pw.CloseWithError(err)
+		runErr <- err
+	}()
+
+	scanner := bufio.NewScanner(pr)
+	scanner.Buffer(make([]byte, 64*1024), scanBufferSize)
+	var fnErr error
+	for fnErr == nil && scanner.Scan() {
+		fnErr = fn(scanner.Text())
+	}
+	if fnErr != nil || scanner.Err() != nil {
+		kill()
+		pr.CloseWithError(errors.New("scan stopped"))
+	}
+	err := <-runErr
+	kill()
+	switch {
+	case fnErr != nil:
+		return fnErr
+	case ctx.Err() != nil:
+		return ctx.Err()
+	case err == nil && scanner.Err() != nil:
+		return scanner.Err()
+	}
+	return err
+}
+
+func (c *command) run(arg ...string) ([][]string, error) {
 
 	var err error
 	var cmd waitable
 	var session *ssh.Session
+	var kill func()
 
 	joinedArgs := strings.Join(arg, " ")
 	c.Path = c.Command+" "+joinedArgs
-	c.Env = []string{"LC_CTYPE=C", "LANG=en_US.UTF-8"}
-	id := uuid.New()
+	c.Env = c.zh.commandEnv()
+	id := OperationID(c.zh.ctx)
+	if id == "" {
+		id = uuid.New()
+	}
+	if err := c.zh.context().Err(); err != nil {
+		return nil, &Error{
+			Err:    fmt.Errorf("command cancelled: %w", err),
+			Debug:  strings.Join([]string{c.Command, joinedArgs}, " "),
+			ID:     id,
+		}
+	}
 	if (c.zh.Local) {
-		logger.Log([]string{"LOCAL:" + id, "START", c.Path})
+		logLine([]string{"LOCAL:" + id, "START", c.Path})
 		lcmd := c.LocalPrepare(arg...)
 		err = lcmd.Start()
 		cmd = lcmd
+		kill = func() {
+			lcmd.Process.Kill()
+		}
 	} else {
-		logger.Log([]string{"REMOTE:" + id, "START", c.Path})
+		logLine([]string{"REMOTE:" + id, "START", c.Path})
 		err, session = c.StartCommand()
 		if (session != nil) {
 			defer func() {
@@ -84,26 +237,71 @@ func (c *command) Run(arg ...string) ([][]string, error) {
 			}()
 		}
 		cmd = session
+		kill = func() {
+			session.Signal(ssh.SIGKILL)
+			session.Close()
+		}
 	}
 
-	logger.Log([]string{"ID:" + id, "DONE"})
-
 	if err != nil {
+		logLine([]string{"ID:" + id, "DONE", "error: " + err.Error()})
 		return nil, &Error{
 			Err:    err,
 			Debug:  strings.Join([]string{c.Command, joinedArgs}, " "),
 			Stderr: c.stderr.String(),
+			ID:     id,
+			Transport: !c.zh.Local,
 		}
 	}
 
-	if err = cmd.Wait(); err != nil {
+	var timedOut int32
+	if c.timeout > 0 {
+		timer := time.AfterFunc(c.timeout, func() {
+			atomic.StoreInt32(&timedOut, 1)
+			kill()
+		})
+		defer timer.Stop()
+	}
+
+	// local commands are killed by exec.CommandContext, remote ones here
+	ctx := c.zh.context()
+	if c.cancel != nil || !c.zh.Local && ctx.Done() != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-c.cancel:
+				kill()
+			case <-ctx.Done():
+				kill()
+			case <-stop:
+			}
+		}()
+	}
+
+	err = cmd.Wait()
+	if err != nil {
+		transport := false
+		if atomic.LoadInt32(&timedOut) != 0 {
+			err = ErrTimeout
+		} else if ctx.Err() != nil {
+			err = fmt.Errorf("command cancelled: %w", ctx.Err())
+		} else if _, exited := err.(*ssh.ExitError); !c.zh.Local && !exited {
+			// the session ended without an exit status
+			transport = true
+		}
+		logLine([]string{"ID:" + id, "DONE", "error: " + err.Error()})
 		return nil, &Error{
 			Err:    err,
 			Stderr: c.stderr.String(),
 			Debug:  strings.Join([]string{c.Command, joinedArgs}, " "),
+			ID:     id,
+			Transport: transport,
 		}
 	}
 
+	logLine([]string{"ID:" + id, "DONE", "ok"})
+
 	// assume if you passed in something for stdout, that you know what to do with it
 	if c.Stdout != nil {
 		return nil, nil
@@ -142,6 +340,45 @@ func setUint(field *uint64, value string) error {
 	return nil
 }
 
+// setTime sets field to the UTC time of value, seconds since the epoch as
+// printed by zfs get -p.
+func setTime(field *time.Time, value string) error {
+	var t time.Time
+	if value != "-" {
+		secs, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		t = time.Unix(secs, 0).UTC()
+	}
+	*field = t
+	return nil
+}
+
+// formatStringer formats s through its String method, except for %+v and
+// %#v which print the fields of raw, a pointer to the same value without
+// methods.
+func formatStringer(f fmt.State, verb rune, s fmt.Stringer, raw interface{}) {
+	directive := "%"
+	for _, flag := range "+-# 0" {
+		if f.Flag(int(flag)) {
+			directive += string(flag)
+		}
+	}
+	if width, ok := f.Width(); ok {
+		directive += strconv.Itoa(width)
+	}
+	if prec, ok := f.Precision(); ok {
+		directive += "." + strconv.Itoa(prec)
+	}
+	directive += string(verb)
+	if verb == 'v' && (f.Flag('+') || f.Flag('#')) {
+		fmt.Fprintf(f, directive, raw)
+		return
+	}
+	fmt.Fprintf(f, directive, s.String())
+}
+
 func (ds *Dataset) parseLine(line []string) error {
 	if len(line) != len(DsPropList) {
 		return errors.New("ZFS output does not match what is expected" +
@@ -162,9 +399,31 @@ func (ds *Dataset) parseLine(line []string) error {
 		setString(&ds.Logicalused, line[10])
 		setString(&ds.ReceiveResumeToken, line[11])
 		setString(&ds.Compressratio, line[12])
-		setString(&ds.Usedbysnapshots, line[13])
 	}
-	return nil
+	setString(&ds.Readonly, dsProp(line, "readonly"))
+	setString(&ds.Usedbysnapshots, dsProp(line, "usedbysnapshots"))
+	setString(&ds.Usedbydataset, dsProp(line, "usedbydataset"))
+	setString(&ds.Usedbychildren, dsProp(line, "usedbychildren"))
+	setString(&ds.Usedbyrefreservation, dsProp(line, "usedbyrefreservation"))
+	setString(&ds.Canmount, dsProp(line, "canmount"))
+	setString(&ds.Snapdir, dsProp(line, "snapdir"))
+	setString(&ds.Sync, dsProp(line, "sync"))
+	setString(&ds.Logbias, dsProp(line, "logbias"))
+	setString(&ds.Primarycache, dsProp(line, "primarycache"))
+	setString(&ds.Secondarycache, dsProp(line, "secondarycache"))
+	setString(&ds.Volmode, dsProp(line, "volmode"))
+	return setTime(&ds.Creation, dsProp(line, "creation"))
+}
+
+// dsProp returns the value of the named property from a line of zfs list
+// output, or "-" if the property is not in DsPropList on this platform.
+func dsProp(line []string, name string) string {
+	for i, prop := range DsPropList {
+		if prop == name {
+			return line[i]
+		}
+	}
+	return "-"
 }
 
 /*
@@ -312,7 +571,203 @@ func parseInodeChanges(lines [][]string) ([]*InodeChange, error) {
 	return changes, nil
 }
 
-func (z *ZfsH) listByType(t, filter string, depth int, recurse bool) ([]*Dataset, error) {
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// inodeArgs returns the ls arguments printing the inode numbers of paths,
+// quoted when they are run through the remote shell.
+func inodeArgs(paths []string, quote bool) []string {
+	args := make([]string, 0, len(paths)+2)
+	args = append(args, "-di", "--")
+	for _, p := range paths {
+		if quote {
+			p = shellQuote(p)
+		}
+		args = append(args, p)
+	}
+	return args
+}
+
+// example input
+//  1234 /pool/fs/a file
+// 56789 /pool/fs/.zfs/snapshot/snap/b
+func parseInodeList(out string) (map[string]uint64, error) {
+	inodes := make(map[string]uint64)
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimLeft(line, " ")
+		if line == "" {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Unexpected ls output: %q", line)
+		}
+		inode, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse inode: %v", err)
+		}
+		inodes[fields[1]] = inode
+	}
+	return inodes, nil
+}
+
+// example input
+//receiving full stream of pool/src@a into pool/dst@a
+//received 46.4K stream in 1 seconds (46.4K/sec)
+//receiving incremental stream of pool/src/child@b into pool/dst/child@b
+func parseReceivedSnapshots(out string) []string {
+	var names []string
+	for _, line := range strings.Split(out, "\n") {
+		if !strings.HasPrefix(line, "receiving ") {
+			continue
+		}
+		if i := strings.LastIndex(line, " into "); i >= 0 {
+			names = append(names, strings.TrimSpace(line[i+len(" into "):]))
+		}
+	}
+	return names
+}
+
+// example input
+//pool/fs	type	filesystem
+//pool/fs	compression	lz4
+//pool/fs@snap	type	snapshot
+func parsePropertyTree(lines [][]string) (map[string]map[string]string, error) {
+	tree := make(map[string]map[string]string)
+	for _, line := range lines {
+		if len(line) != 3 {
+			return nil, fmt.Errorf("Unexpected zfs get output: %q", line)
+		}
+		props, ok := tree[line[0]]
+		if !ok {
+			props = make(map[string]string)
+			tree[line[0]] = props
+		}
+		props[line[1]] = line[2]
+	}
+	return tree, nil
+}
+
+// example input
+//compression	lz4	local
+//user:note	-	-
+func parsePropertyValues(lines [][]string) (map[string]string, error) {
+	values := make(map[string]string)
+	for _, line := range lines {
+		if len(line) != 3 {
+			return nil, fmt.Errorf("Unexpected zfs get output: %q", line)
+		}
+		// a user property which is not set has neither value nor source
+		if strings.Contains(line[0], ":") && line[1] == "-" && line[2] == "-" {
+			continue
+		}
+		values[line[0]] = line[1]
+	}
+	return values, nil
+}
+
+// snapshotClones is a snapshot along with its clones.
+type snapshotClones struct {
+	name      string
+	createtxg uint64
+	clones    []string
+}
+
+// example input
+//pool/fs@a	clones	pool/clone1,pool/clone2
+//pool/fs@a	createtxg	12
+//pool/fs@b	clones
+//pool/fs@b	createtxg	20
+func parseSnapshotClones(lines [][]string) ([]snapshotClones, error) {
+	var snapshots []snapshotClones
+	index := map[string]int{}
+	for _, line := range lines {
+		if len(line) < 2 || len(line) > 3 {
+			return nil, fmt.Errorf("Unexpected zfs get output: %q", line)
+		}
+		i, ok := index[line[0]]
+		if !ok {
+			i = len(snapshots)
+			index[line[0]] = i
+			snapshots = append(snapshots, snapshotClones{name: line[0]})
+		}
+		value := ""
+		if len(line) == 3 && line[2] != "-" {
+			value = line[2]
+		}
+		switch line[1] {
+		case "clones":
+			if value != "" {
+				snapshots[i].clones = strings.Split(value, ",")
+			}
+		case "createtxg":
+			txg, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to parse createtxg: %v", err)
+			}
+			snapshots[i].createtxg = txg
+		}
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].createtxg < snapshots[j].createtxg
+	})
+	return snapshots, nil
+}
+
+// keyRoot is an encryption root and its keylocation.
+type keyRoot struct {
+	name     string
+	location string
+}
+
+// example input
+//pool/secret	encryptionroot	pool/secret
+//pool/secret	keylocation	prompt
+//pool/secret	keystatus	unavailable
+//pool/secret/child	encryptionroot	pool/secret
+//pool/secret/child	keylocation	none
+//pool/secret/child	keystatus	unavailable
+func parseUnavailableKeyRoots(lines [][]string) ([]keyRoot, error) {
+	type keyProps struct {
+		root, location, status string
+	}
+	var names []string
+	props := map[string]*keyProps{}
+	for _, line := range lines {
+		if len(line) != 3 {
+			return nil, fmt.Errorf("Unexpected zfs get output: %q", line)
+		}
+		p, ok := props[line[0]]
+		if !ok {
+			p = &keyProps{}
+			props[line[0]] = p
+			names = append(names, line[0])
+		}
+		switch line[1] {
+		case "encryptionroot":
+			p.root = line[2]
+		case "keylocation":
+			p.location = line[2]
+		case "keystatus":
+			p.status = line[2]
+		}
+	}
+
+	var roots []keyRoot
+	for _, name := range names {
+		p := props[name]
+		if p.root == name && p.status == "unavailable" {
+			roots = append(roots, keyRoot{name: name, location: p.location})
+		}
+	}
+	return roots, nil
+}
+
+// listArgs returns the zfs list arguments for listing the datasets of type
+// t, see listByType.
+func listArgs(t, filter string, depth int, recurse bool) []string {
 	args := []string{"list", "-Hp", "-t", t, "-o", strings.Join(DsPropList, ",")}
 
 	if depth > -1 {
@@ -326,7 +781,80 @@ func (z *ZfsH) listByType(t, filter string, depth int, recurse bool) ([]*Dataset
 	if filter != "" {
 		args = append(args, filter)
 	}
-	out, err := z.zfs(args...)
+	return args
+}
+
+// sendTokenFlags are the send flags which may be combined with
+// SendWithToken; the others are encoded in the resume token.
+const sendTokenFlags = SendDefault | SendWithToken | SendEmbeddedData
+
+// sendArgs returns the zfs send arguments for sending ds0, incrementally
+// from ds1, see SendSnapshot.
+func sendArgs(ds0, ds1 string, sendflags SendFlag, extra []string) ([]string, error) {
+	if sendflags&SendWithToken != 0 {
+		if !validResumeToken(ds0) {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidResumeToken, ds0)
+		}
+		if sendflags&^sendTokenFlags != 0 {
+			return nil, errors.New("Only SendEmbeddedData may be combined with SendWithToken, the other flags are taken from the token")
+		}
+	}
+
+	args := make([]string, 1, 5)
+	args[0] = "send"
+
+	if sendflags&SendRecursive != 0 {
+		args = append(args, "-R")
+	}
+
+	if sendflags&SendLz4 != 0 {
+		args = append(args, "-c")
+	}
+
+	if sendflags&SendEmbeddedData != 0 {
+		args = append(args, "-e")
+	}
+
+	if sendflags&SendProps != 0 {
+		args = append(args, "-p")
+	}
+
+	if sendflags&SendBackupProps != 0 {
+		args = append(args, "-b")
+	}
+
+	if sendflags&SendRaw != 0 {
+		args = append(args, "-w")
+	}
+
+	if sendflags&SendDedup != 0 {
+		args = append(args, "-D")
+	}
+
+	if sendflags&SendSaved != 0 {
+		args = append(args, "-S")
+	}
+
+	if sendflags&SendIncremental != 0 {
+		if ds1 == "" {
+			return nil, errors.New("Source snapshot must be set for incremental send")
+		}
+		if sendflags&SendIntermediate != 0 {
+			args = append(args, "-I", ds1)
+		} else {
+			args = append(args, "-i", ds1)
+		}
+	}
+	args = append(args, extra...)
+	if sendflags&SendWithToken != 0 {
+		// the token is the argument of -t
+		args = append(args, "-t")
+	}
+	return append(args, ds0), nil
+}
+
+func (z *ZfsH) listByType(t, filter string, depth int, recurse bool) ([]*Dataset, error) {
+	out, err := z.zfs(listArgs(t, filter, depth, recurse)...)
 	if err != nil {
 		return nil, err
 	}
@@ -367,6 +895,462 @@ func (z *Zpool) parseLine(line []string) error {
 	setString(&z.Allocated, line[2])
 	setString(&z.Size, line[3])
 	setString(&z.Free, line[4])
+	setString(&z.Guid, line[5])
+
+	return nil
+}
+
+// isExcluded reports whether name is one of exclude or a descendent of one.
+func isExcluded(name string, exclude []string) bool {
+	for _, e := range exclude {
+		if name == e || strings.HasPrefix(name, e+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSize parses a human readable size as printed by zfs and zpool
+// (e.g. "0", "512B", "1.50G") into bytes.
+func parseSize(value string) (uint64, error) {
+	units := "BKMGTPE"
+	v := strings.TrimSuffix(value, "B")
+	if v == "" {
+		v = "0"
+	}
+	mult := float64(1)
+	if i := strings.IndexByte(units, v[len(v)-1]); i > 0 {
+		for ; i > 0; i-- {
+			mult *= 1024
+		}
+		v = v[:len(v)-1]
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid size '%s': %v", value, err)
+	}
+	return uint64(f * mult), nil
+}
+
+// blockSizeProps are the properties holding a block size, which must be a
+// power of two from 512 bytes to 16MB.
+var blockSizeProps = []string{"recordsize", "volblocksize"}
+
+const (
+	minBlockSize = 512
+	maxBlockSize = 16 * 1024 * 1024
+)
+
+// checkBlockSizes validates the block size properties among properties and
+// returns their values in bytes.
+func checkBlockSizes(properties map[string]string) (map[string]uint64, error) {
+	sizes := map[string]uint64{}
+	for _, prop := range blockSizeProps {
+		value, ok := properties[prop]
+		if !ok {
+			continue
+		}
+		size, err := parseSize(strings.ToUpper(value))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s: %v", prop, err)
+		}
+		if size < minBlockSize || size > maxBlockSize || size&(size-1) != 0 {
+			return nil, fmt.Errorf("Invalid %s '%s': must be a power of two from 512 to 16M", prop, value)
+		}
+		sizes[prop] = size
+	}
+	return sizes, nil
+}
+
+var scanDurationRegex = regexp.MustCompile("^(?:(\\d+) days? )?(\\d+):(\\d+):(\\d+)$")
+
+// parseScanDuration parses a scan duration, either "1 days 02:03:04" or the
+// older "2h3m" form.
+func parseScanDuration(value string) (time.Duration, error) {
+	if strings.HasSuffix(value, "m") {
+		return time.ParseDuration(value)
+	}
+	m := scanDurationRegex.FindStringSubmatch(value)
+	if m == nil {
+		return 0, fmt.Errorf("Invalid scan duration '%s'", value)
+	}
+	var total time.Duration
+	for i, unit := range []time.Duration{24 * time.Hour, time.Hour, time.Minute, time.Second} {
+		if m[i+1] == "" {
+			continue
+		}
+		n, _ := strconv.Atoi(m[i+1])
+		total += time.Duration(n) * unit
+	}
+	return total, nil
+}
+
+func parseScanTime(value string) (time.Time, error) {
+	return time.ParseInLocation("Mon Jan _2 15:04:05 2006", value, time.Local)
+}
+
+var (
+	scanFinishedRegex  = regexp.MustCompile("^(scrub repaired|resilvered) (\\S+) in (.+) with (\\d+) errors on (.+)$")
+	scanRunningRegex   = regexp.MustCompile("^(scrub|resilver) (in progress|paused) since (.+)$")
+	scanCanceledRegex  = regexp.MustCompile("^(scrub|resilver) canceled on (.+)$")
+	scanProgressRegex  = regexp.MustCompile("(\\S+) scanned")
+	scanRepairedRegex  = regexp.MustCompile("(\\S+) (?:repaired|resilvered),")
+	statusSectionRegex = regexp.MustCompile("^\\s*[a-z]+:(\\s|$)")
+)
+
+// example input
+//  pool: tank
+// state: ONLINE
+//  scan: scrub in progress since Sun Oct 11 00:24:02 2020
+//	1.23G scanned at 100M/s, 500M issued at 50M/s, 10G total
+//	0B repaired, 5.00% done, 00:03:00 to go
+//config:
+func parseScanStatus(status string) (*ScrubInfo, error) {
+	var scan []string
+	for _, line := range strings.Split(status, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if scan == nil {
+			if strings.HasPrefix(trimmed, "scan:") {
+				scan = append(scan, strings.TrimSpace(strings.TrimPrefix(trimmed, "scan:")))
+			}
+			continue
+		}
+		if trimmed == "" || statusSectionRegex.MatchString(line) {
+			break
+		}
+		scan = append(scan, trimmed)
+	}
+	if scan == nil {
+		return nil, fmt.Errorf("No scan line in zpool status")
+	}
+
+	info := &ScrubInfo{Raw: strings.Join(scan, "\n")}
+	var err error
+	if scan[0] == "none requested" {
+		info.State = ScanNone
+	} else if m := scanFinishedRegex.FindStringSubmatch(scan[0]); m != nil {
+		info.State = ScanFinished
+		info.Function = "scrub"
+		amount, err := parseSize(m[2])
+		if err != nil {
+			return nil, err
+		}
+		if m[1] == "resilvered" {
+			info.Function = "resilver"
+			info.Scanned = amount
+		} else {
+			info.Repaired = amount
+		}
+		if info.Duration, err = parseScanDuration(m[3]); err != nil {
+			return nil, err
+		}
+		if info.Errors, err = strconv.ParseUint(m[4], 10, 64); err != nil {
+			return nil, err
+		}
+		if info.Completed, err = parseScanTime(m[5]); err != nil {
+			return nil, err
+		}
+	} else if m := scanRunningRegex.FindStringSubmatch(scan[0]); m != nil {
+		info.Function = m[1]
+		info.State = ScanInProgress
+		if m[2] == "paused" {
+			info.State = ScanPaused
+		}
+		if info.Started, err = parseScanTime(m[3]); err != nil {
+			return nil, err
+		}
+		progress := strings.Join(scan[1:], " ")
+		if p := scanProgressRegex.FindStringSubmatch(progress); p != nil {
+			if info.Scanned, err = parseSize(p[1]); err != nil {
+				return nil, err
+			}
+		}
+		if p := scanRepairedRegex.FindStringSubmatch(progress); p != nil {
+			if info.Repaired, err = parseSize(p[1]); err != nil {
+				return nil, err
+			}
+		}
+	} else if m := scanCanceledRegex.FindStringSubmatch(scan[0]); m != nil {
+		info.Function = m[1]
+		info.State = ScanCanceled
+		if info.Completed, err = parseScanTime(m[2]); err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, fmt.Errorf("Unknown scan status '%s'", scan[0])
+	}
+	return info, nil
+}
+
+// parseDestroyOutput parses the output of zfs destroy -nv, with or without
+// -p, into the names that would be destroyed and the space that would be
+// reclaimed.
+//
+// example input
+//destroy	pool/fs@snap
+//reclaim	1024
+func parseDestroyOutput(lines [][]string) ([]string, uint64) {
+	var names []string
+	var reclaim uint64
+	for _, line := range lines {
+		if len(line) > 1 && line[0] == "would" {
+			line = line[1:]
+		}
+		if len(line) != 2 {
+			continue
+		}
+		switch line[0] {
+		case "destroy":
+			names = append(names, line[1])
+		case "reclaim":
+			if v, err := parseSize(line[1]); err == nil {
+				reclaim = v
+			}
+		}
+	}
+	return names, reclaim
+}
 
+var sendUsageRegex = regexp.MustCompile("send \\[-([A-Za-z]+)\\]")
+
+// example input
+//	send [-DnPpRvLecwhb] [-[iI] snapshot] <snapshot>
+//	send [-nvPLecw] [-i snapshot|bookmark] <filesystem|volume|snapshot>
+func parseSendUsage(usage string) *SendFeatureSet {
+	features := &SendFeatureSet{}
+	for _, m := range sendUsageRegex.FindAllStringSubmatch(usage, -1) {
+		features.options += m[1]
+	}
+	return features
+}
+
+// modifiedSince returns the filesystems and volumes of datasets which may
+// have been modified since t, see DatasetsModifiedSince.  The snapshots of
+// the datasets must be included.
+func modifiedSince(datasets []*Dataset, t time.Time) []*Dataset {
+	newest := make(map[string]time.Time)
+	for _, ds := range datasets {
+		if ds.Type == DatasetSnapshot {
+			parent := parentName(ds.Name)
+			if ds.Creation.After(newest[parent]) {
+				newest[parent] = ds.Creation
+			}
+		}
+	}
+	var modified []*Dataset
+	for _, ds := range datasets {
+		if ds.Type != DatasetFilesystem && ds.Type != DatasetVolume {
+			continue
+		}
+		// written is not available on every platform, assume modified
+		if ds.Creation.After(t) || newest[ds.Name].After(t) || ds.Written != "0" {
+			modified = append(modified, ds)
+		}
+	}
+	return modified
+}
+
+// example input
+//pool/fs	4096
+//pool/fs/child	0
+//pool/fs/new	-
+func parseWrittenSince(lines [][]string) (map[string]uint64, error) {
+	written := make(map[string]uint64, len(lines))
+	for _, line := range lines {
+		if len(line) != 2 {
+			return nil, fmt.Errorf("Unexpected zfs get output: %q", line)
+		}
+		if line[1] == "-" {
+			continue
+		}
+		v, err := strconv.ParseUint(line[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Unexpected zfs get output: %q", line)
+		}
+		written[line[0]] = v
+	}
+	return written, nil
+}
+
+var resumeTokenRegex = regexp.MustCompile("^\\d+-[0-9a-f]+-[0-9a-f]+-[0-9a-f]+$")
+
+// validResumeToken reports whether token has the format of a
+// receive_resume_token: version-checksum-length-payload, all but the
+// version in hex.
+//
+// example input
+//1-e604ea4bf-e0-789c63a2
+func validResumeToken(token string) bool {
+	return resumeTokenRegex.MatchString(token)
+}
+
+// example input
+//pool/fs@a	keep	Thu Oct 15 10:12 2026
+//pool/fs@a	replication	Thu Oct 15 10:13 2026
+//pool/fs/child@a	keep	Thu Oct 15 10:12 2026
+func parseHolds(lines [][]string) (map[string][]string, error) {
+	holds := make(map[string][]string)
+	for _, line := range lines {
+		if len(line) != 3 {
+			return nil, fmt.Errorf("Unexpected zfs holds output: %q", line)
+		}
+		holds[line[0]] = append(holds[line[0]], line[1])
+	}
+	return holds, nil
+}
+
+// isUnderPath reports whether path is prefix or lies below it.
+func isUnderPath(path, prefix string) bool {
+	if prefix == "/" {
+		return strings.HasPrefix(path, "/")
+	}
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// poolName returns the name of the pool the named dataset belongs to.
+func poolName(name string) string {
+	if i := strings.IndexAny(name, "/@#"); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
+
+// parentName returns the name of the parent of the named dataset, or ""
+// for a pool root.  The parent of a snapshot or bookmark is the dataset it
+// belongs to.
+func parentName(name string) string {
+	if i := strings.IndexAny(name, "@#"); i >= 0 {
+		return name[:i]
+	}
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		return name[:i]
+	}
+	return ""
+}
+
+var dedupStatusRegex = regexp.MustCompile("dedup: DDT entries (\\d+), size (\\S+) on disk, (\\S+) in core")
+
+// example input
+// dedup: DDT entries 1234, size 304B on disk, 160B in core
+func parseDedupStatus(status string) (*DedupInfo, error) {
+	info := &DedupInfo{}
+	m := dedupStatusRegex.FindStringSubmatch(status)
+	if m == nil {
+		if strings.Contains(status, "dedup: no DDT entries") {
+			return info, nil
+		}
+		return nil, errors.New("No dedup statistics in zpool status")
+	}
+	var err error
+	if info.Entries, err = strconv.ParseUint(m[1], 10, 64); err != nil {
+		return nil, fmt.Errorf("Invalid DDT entries '%s': %v", m[1], err)
+	}
+	if info.EntrySizeOnDisk, err = parseSize(m[2]); err != nil {
+		return nil, err
+	}
+	if info.EntrySizeInCore, err = parseSize(m[3]); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// example input
+//errors: Permanent errors have been detected in the following files:
+//
+//        /tank/fs/file
+//        tank/fs:<0x1>
+func parsePermanentErrors(status string) []string {
+	files := []string{}
+	inErrors := false
+	for _, line := range strings.Split(status, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "errors:") {
+			inErrors = strings.Contains(trimmed, "Permanent errors")
+			continue
+		}
+		if inErrors && trimmed != "" {
+			files = append(files, trimmed)
+		}
+	}
+	return files
+}
+
+// splitTabbed splits the output of a zfs -H command into lines of tab
+// separated fields.
+func splitTabbed(output string) [][]string {
+	lines := strings.Split(strings.TrimSuffix(output, "\n"), "\n")
+	if len(lines) == 1 && lines[0] == "" {
+		return nil
+	}
+	out := make([][]string, len(lines))
+	for i, l := range lines {
+		out[i] = strings.Split(l, "\t")
+	}
+	return out
+}
+
+// shellMetacharacters are rejected in extra arguments, as remote and piped
+// commands are run through a shell.
+const shellMetacharacters = "|&;<>()$`\\\"' \t\n*?[]{}~"
+
+// checkExtraArgs validates raw arguments passed through to zfs.
+func checkExtraArgs(extra []string) error {
+	for _, arg := range extra {
+		if arg == "" || strings.ContainsAny(arg, shellMetacharacters) {
+			return fmt.Errorf("Invalid extra argument %q", arg)
+		}
+	}
 	return nil
 }
+
+// remapsReceiveName reports whether the raw zfs receive arguments contain -d
+// or -e, which make zfs derive the received dataset's name from the sent
+// snapshot's rather than use the given name as is.
+func remapsReceiveName(extra []string) bool {
+	for _, arg := range extra {
+		if strings.HasPrefix(arg, "-") && !strings.HasPrefix(arg, "--") &&
+			!strings.Contains(arg, "=") && strings.ContainsAny(arg[1:], "de") {
+			return true
+		}
+	}
+	return false
+}
+
+// example input
+//incremental	pool/fs@a	pool/fs@b	4120
+//size	4120
+func parseSendSize(output string) (uint64, error) {
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "size" {
+			return strconv.ParseUint(fields[1], 10, 64)
+		}
+	}
+	return 0, fmt.Errorf("No size in zfs send estimate")
+}
+
+// example input
+//FEAT DESCRIPTION
+//-------------------------------------------------------------
+//async_destroy                         (read-only compatible)
+//     Destroy filesystems asynchronously.
+//lz4_compress
+//     LZ4 compression algorithm support.
+//
+//The following legacy versions are also supported:
+func parseReadOnlyFeatures(usage string) map[string]bool {
+	readOnly := make(map[string]bool)
+	inFeatures := false
+	for _, line := range strings.Split(usage, "\n") {
+		switch {
+		case strings.HasPrefix(line, "---"):
+			inFeatures = true
+		case strings.HasPrefix(line, "The following legacy"):
+			return readOnly
+		case inFeatures && line != "" && line[0] != ' ' && line[0] != '\t':
+			fields := strings.Fields(line)
+			readOnly[fields[0]] = strings.Contains(line, "(read-only compatible)")
+		}
+	}
+	return readOnly
+}
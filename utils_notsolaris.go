@@ -3,7 +3,7 @@
 package zfs
 
 // List of ZFS properties to retrieve from zfs list command on a non-Solaris platform
-var DsPropList = []string{"name", "origin", "used", "available", "mountpoint", "compression", "type", "volsize", "quota", "written", "logicalused", "receive_resume_token", "compressratio", "usedbysnapshots"}
+var DsPropList = []string{"name", "origin", "used", "available", "mountpoint", "compression", "type", "volsize", "quota", "written", "logicalused", "receive_resume_token", "compressratio", "usedbysnapshots", "readonly", "usedbydataset", "usedbychildren", "usedbyrefreservation", "canmount", "snapdir", "creation", "sync", "logbias", "primarycache", "secondarycache", "volmode"}
 
 // List of Zpool properties to retrieve from zpool list command on a non-Solaris platform
-var ZpoolPropList = []string{"name", "health", "allocated", "size", "free"}
+var ZpoolPropList = []string{"name", "health", "allocated", "size", "free", "guid"}
@@ -3,7 +3,7 @@
 package zfs
 
 // List of ZFS properties to retrieve from zfs list command on a Solaris platform
-var DsPropList = []string{"name", "origin", "used", "available", "mountpoint", "compression", "type", "volsize", "quota"}
+var DsPropList = []string{"name", "origin", "used", "available", "mountpoint", "compression", "type", "volsize", "quota", "readonly", "usedbysnapshots", "usedbydataset", "usedbychildren", "usedbyrefreservation", "canmount", "snapdir", "creation", "sync", "logbias", "primarycache", "secondarycache"}
 
 // List of Zpool properties to retrieve from zpool list command on a Solaris platform
-var ZpoolPropList = []string{"name", "health", "allocated", "size", "free"}
+var ZpoolPropList = []string{"name", "health", "allocated", "size", "free", "guid"}
@@ -0,0 +1,785 @@
+package zfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseSize(t *testing.T) {
+	var tests = []struct {
+		in  string
+		out uint64
+	}{
+		{"0", 0},
+		{"0B", 0},
+		{"512B", 512},
+		{"1K", 1024},
+		{"1.50G", 1610612736},
+	}
+
+	for _, test := range tests {
+		size, err := parseSize(test.in)
+		if err != nil {
+			t.Fatalf("unexpected error parsing %q: %v", test.in, err)
+		}
+		if size != test.out {
+			t.Fatalf("parseSize(%q) = %d, expected %d", test.in, size, test.out)
+		}
+	}
+}
+
+func TestParseScanStatus(t *testing.T) {
+	var tests = []struct {
+		status   string
+		function string
+		state    string
+		duration time.Duration
+		scanned  uint64
+		repaired uint64
+		errors   uint64
+	}{
+		{"  pool: tank\n state: ONLINE\n  scan: none requested\nconfig:\n",
+			"", ScanNone, 0, 0, 0, 0},
+		{"  pool: tank\n  scan: scrub repaired 1K in 00:00:05 with 2 errors on Sun Oct 11 00:24:02 2020\nconfig:\n",
+			"scrub", ScanFinished, 5 * time.Second, 0, 1024, 2},
+		{"  pool: tank\n  scan: scrub repaired 0 in 1h2m with 0 errors on Sun Oct 11 00:24:02 2020\nconfig:\n",
+			"scrub", ScanFinished, time.Hour + 2*time.Minute, 0, 0, 0},
+		{"  pool: tank\n  scan: resilvered 2M in 1 days 00:00:01 with 0 errors on Sun Oct 11 00:24:02 2020\nconfig:\n",
+			"resilver", ScanFinished, 24*time.Hour + time.Second, 2097152, 0, 0},
+		{"  pool: tank\n  scan: scrub in progress since Sun Oct 11 00:24:02 2020\n\t1K scanned at 100M/s, 500M issued at 50M/s, 10G total\n\t512B repaired, 5.00% done, 00:03:00 to go\nconfig:\n",
+			"scrub", ScanInProgress, 0, 1024, 512, 0},
+		{"  pool: tank\n  scan: scrub canceled on Sun Oct 11 00:24:02 2020\nconfig:\n",
+			"scrub", ScanCanceled, 0, 0, 0, 0},
+	}
+
+	for _, test := range tests {
+		info, err := parseScanStatus(test.status)
+		if err != nil {
+			t.Fatalf("unexpected error parsing %q: %v", test.status, err)
+		}
+		if info.Function != test.function || info.State != test.state ||
+			info.Duration != test.duration || info.Scanned != test.scanned ||
+			info.Repaired != test.repaired || info.Errors != test.errors {
+			t.Fatalf("unexpected scrub info for %q: %+v", test.status, info)
+		}
+	}
+
+	if _, err := parseScanStatus("  pool: tank\nconfig:\n"); err == nil {
+		t.Fatalf("expected an error for status without scan line")
+	}
+}
+
+func TestParseDestroyOutput(t *testing.T) {
+	names, reclaim := parseDestroyOutput([][]string{
+		{"destroy", "pool/fs@snap"},
+		{"destroy", "pool/clone"},
+		{"reclaim", "4096"},
+	})
+	if len(names) != 2 || names[0] != "pool/fs@snap" || names[1] != "pool/clone" {
+		t.Fatalf("unexpected destroyed names: %v", names)
+	}
+	if reclaim != 4096 {
+		t.Fatalf("unexpected reclaim: %d", reclaim)
+	}
+
+	names, reclaim = parseDestroyOutput([][]string{
+		{"would", "destroy", "pool/fs@snap"},
+		{"would", "reclaim", "1K"},
+	})
+	if len(names) != 1 || names[0] != "pool/fs@snap" || reclaim != 1024 {
+		t.Fatalf("unexpected result: %v %d", names, reclaim)
+	}
+}
+
+func TestParseSendUsage(t *testing.T) {
+	usage := "usage:\n\tsend [-DnPpRvLecwhb] [-[iI] snapshot] <snapshot>\n" +
+		"\tsend [-nvPLecw] [-i snapshot|bookmark] <filesystem|volume|snapshot>\n"
+	features := parseSendUsage(usage)
+	if !features.Supports(SendLz4 | SendBackupProps | SendProps) {
+		t.Fatalf("expected -c, -b and -p to be supported: %q", features.options)
+	}
+
+	features = parseSendUsage("\tsend [-DnPpRv] [-[iI] snapshot] <snapshot>\n")
+	if features.Supports(SendBackupProps) || !features.Supports(SendProps|SendDedup) {
+		t.Fatalf("unexpected features: %q", features.options)
+	}
+
+	features = parseSendUsage("\tsend [-nVvPLecwhb] [-[iI] snapshot] <snapshot>\n")
+	if features.Supports(SendDedup) {
+		t.Fatalf("expected -D to be unsupported: %q", features.options)
+	}
+}
+
+func TestBinaries(t *testing.T) {
+	zh := NewLocalHandle()
+	if zh.wrap("zfs") != "zfs" || zh.wrap("zpool") != "zpool" {
+		t.Fatalf("expected the default binaries, got: %q %q", zh.wrap("zfs"), zh.wrap("zpool"))
+	}
+	zh.Sudo = true
+	zh.ZfsBinary = "/usr/local/sbin/zfs"
+	zh.ZpoolBinary = "/usr/local/sbin/zpool"
+	if cmd := zh.wrap("zfs"); cmd != "sudo -n /usr/local/sbin/zfs" {
+		t.Fatalf("unexpected zfs command: %q", cmd)
+	}
+	if cmd := zh.wrap("zpool"); cmd != "sudo -n /usr/local/sbin/zpool" {
+		t.Fatalf("unexpected zpool command: %q", cmd)
+	}
+	if cmd := zh.wrap("mount"); cmd != "sudo -n mount" {
+		t.Fatalf("unexpected mount command: %q", cmd)
+	}
+}
+
+func TestCommandEnv(t *testing.T) {
+	zh := NewLocalHandle()
+	if len(zh.commandEnv()) == 0 {
+		t.Fatalf("expected a locale override by default")
+	}
+
+	zh.NoLocaleOverride = true
+	if env := zh.commandEnv(); len(env) != 0 {
+		t.Fatalf("expected no environment, got: %v", env)
+	}
+}
+
+type recordingLogger struct {
+	sync.Mutex
+	lines [][]string
+}
+
+func (l *recordingLogger) Log(cmd []string) {
+	l.Lock()
+	l.lines = append(l.lines, cmd)
+	l.Unlock()
+}
+
+func TestOperationID(t *testing.T) {
+	rec := &recordingLogger{}
+	SetLogger(rec)
+	defer SetLogger(&defaultLogger{})
+
+	zh := NewLocalHandle().WithContext(WithOperationID(context.Background(), "op-1"))
+	c := command{Command: "false", zh: zh}
+	_, err := c.Run()
+	var zerr *Error
+	if !errors.As(err, &zerr) || zerr.ID != "op-1" {
+		t.Fatalf("expected an error carrying the operation ID, got: %v", err)
+	}
+	if len(rec.lines) != 2 || rec.lines[0][0] != "LOCAL:op-1" || rec.lines[1][0] != "ID:op-1" ||
+		rec.lines[1][2] != "error: exit status 1" {
+		t.Fatalf("unexpected log lines: %v", rec.lines)
+	}
+
+	rec.lines = nil
+	c = command{Command: "true", zh: zh}
+	if _, err = c.Run(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(rec.lines) != 2 || rec.lines[1][2] != "ok" {
+		t.Fatalf("unexpected log lines: %v", rec.lines)
+	}
+}
+
+func TestOperationLabel(t *testing.T) {
+	zh := NewLocalHandle()
+	zh.Sudo = true
+	if cmd := zh.wrap("zfs"); cmd != "sudo -n zfs" {
+		t.Fatalf("unexpected command without label: %q", cmd)
+	}
+
+	zh = zh.WithContext(WithOperationLabel(context.Background(), "backup job; #42"))
+	if cmd := zh.wrap("zfs"); cmd != "sudo -n env ZFS_OPERATION=backup_job___42 zfs" {
+		t.Fatalf("unexpected command with label: %q", cmd)
+	}
+}
+
+func TestParsePermanentErrors(t *testing.T) {
+	files := parsePermanentErrors("  pool: tank\nconfig:\n\nerrors: No known data errors\n")
+	if files == nil || len(files) != 0 {
+		t.Fatalf("expected an empty slice, got: %#v", files)
+	}
+
+	files = parsePermanentErrors("  pool: tank\nconfig:\n\n" +
+		"errors: Permanent errors have been detected in the following files:\n\n" +
+		"        /tank/fs/my file\n        tank/fs:<0x1>\n")
+	if len(files) != 2 || files[0] != "/tank/fs/my file" || files[1] != "tank/fs:<0x1>" {
+		t.Fatalf("unexpected files: %#v", files)
+	}
+}
+
+func TestSplitTabbed(t *testing.T) {
+	if out := splitTabbed(""); len(out) != 0 {
+		t.Fatalf("expected no lines, got: %#v", out)
+	}
+
+	out := splitTabbed("pool/fs\tsome value\npool/fs/child\t-\n")
+	if len(out) != 2 || out[0][1] != "some value" || out[1][0] != "pool/fs/child" {
+		t.Fatalf("unexpected output: %#v", out)
+	}
+}
+
+func TestCheckExtraArgs(t *testing.T) {
+	if err := checkExtraArgs([]string{"-o", "compression=lz4", "-x", "mountpoint"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, arg := range []string{"", "-v; rm -rf /", "$(reboot)", "a|b", "x y"} {
+		if err := checkExtraArgs([]string{arg}); err == nil {
+			t.Fatalf("expected an error for %q", arg)
+		}
+	}
+}
+
+func TestTailBuffer(t *testing.T) {
+	tail := tailBuffer{max: 4}
+	tail.Write([]byte("abc"))
+	tail.Write([]byte("defg"))
+	if tail.String() != "defg" {
+		t.Fatalf("unexpected tail: %q", tail.String())
+	}
+
+	all := tailBuffer{}
+	all.Write([]byte("abc"))
+	all.Write([]byte("defg"))
+	if all.String() != "abcdefg" {
+		t.Fatalf("unexpected content: %q", all.String())
+	}
+}
+
+func TestMaxStderrCapture(t *testing.T) {
+	zh := NewLocalHandle()
+	zh.MaxStderrCapture = 6
+	c := command{Command: "sh", zh: zh}
+	_, err := c.Run("-c", "echo 'warning warning error' >&2; exit 1")
+	var zerr *Error
+	if !errors.As(err, &zerr) || zerr.Stderr != "error\n" {
+		t.Fatalf("expected the stderr tail, got: %#v", err)
+	}
+	if zerr.IsTransport() {
+		t.Fatalf("a failing local command is not a transport error")
+	}
+
+	if zh.MaxStderrCapture = 0; zh.stderrCapture() != stderrTailSize {
+		t.Fatalf("expected the default capture size")
+	}
+	if zh.MaxStderrCapture = -1; zh.stderrCapture() != 0 {
+		t.Fatalf("expected an unlimited capture size")
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	zh := &ZfsH{}
+	tests := []struct {
+		command string
+		arg     []string
+		want    bool
+	}{
+		{"sudo -n zfs", []string{"list", "-H"}, true},
+		{"/usr/local/sbin/zpool", []string{"list"}, true},
+		{"zfs", []string{"get", "all", "pool/fs"}, true},
+		{"zpool", []string{"status", "pool"}, true},
+		{"zfs", []string{"destroy", "pool/fs"}, false},
+		{"zpool", []string{"scrub", "pool"}, false},
+		{"zfs", []string{"list", "|", "head"}, false},
+		{"zfs", nil, false},
+	}
+	for _, test := range tests {
+		c := command{Command: test.command, zh: zh}
+		if got := c.retryable(test.arg); got != test.want {
+			t.Errorf("%s %v: expected %v, got %v", test.command, test.arg, test.want, got)
+		}
+	}
+
+	c := command{Command: "zfs", Stdout: os.Stdout, zh: zh}
+	if c.retryable([]string{"list"}) {
+		t.Errorf("a streaming command must not be retried")
+	}
+	c = command{Command: "zfs", zh: NewLocalHandle()}
+	if c.retryable([]string{"list"}) {
+		t.Errorf("a local command must not be retried")
+	}
+}
+
+func TestStringers(t *testing.T) {
+	ds := &Dataset{Name: "pool/fs", Type: DatasetFilesystem, Used: "1024", Avail: "2048"}
+	if s := fmt.Sprintf("%s", ds); s != "pool/fs (filesystem, 1024/2048)" {
+		t.Errorf("unexpected dataset string: %q", s)
+	}
+	if s := fmt.Sprintf("%+v", ds); !strings.Contains(s, "Mountpoint:") {
+		t.Errorf("expected a detailed dump, got: %q", s)
+	}
+
+	zp := &Zpool{Name: "pool", Health: ZpoolOnline, Allocated: "10", Size: "100"}
+	if s := fmt.Sprintf("%v", zp); s != "pool (ONLINE, 10/100)" {
+		t.Errorf("unexpected pool string: %q", s)
+	}
+	if s := fmt.Sprintf("%+v", zp); !strings.Contains(s, "Guid:") {
+		t.Errorf("expected a detailed dump, got: %q", s)
+	}
+}
+
+func TestCommandCancel(t *testing.T) {
+	cancel := make(chan struct{})
+	c := command{Command: "sleep", zh: NewLocalHandle(), cancel: cancel}
+	time.AfterFunc(50*time.Millisecond, func() { close(cancel) })
+	start := time.Now()
+	if _, err := c.Run("10"); err == nil {
+		t.Fatalf("expected the cancelled command to fail")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatalf("command was not killed")
+	}
+}
+
+func TestJailPlatform(t *testing.T) {
+	if runtime.GOOS == "freebsd" {
+		t.Skip("jails are supported on freebsd")
+	}
+	zh := NewLocalHandle()
+	d := &Dataset{Name: "pool/jailed"}
+	if err := zh.Jail(d, "1"); !errors.Is(err, ErrUnsupportedPlatform) {
+		t.Errorf("expected ErrUnsupportedPlatform, got: %v", err)
+	}
+	if err := zh.Unjail(d, "1"); !errors.Is(err, ErrUnsupportedPlatform) {
+		t.Errorf("expected ErrUnsupportedPlatform, got: %v", err)
+	}
+}
+
+func TestParseLineCreation(t *testing.T) {
+	line := make([]string, len(DsPropList))
+	for i, prop := range DsPropList {
+		line[i] = "-"
+		if prop == "creation" {
+			line[i] = "1546263000"
+		}
+	}
+	ds := &Dataset{}
+	if err := ds.parseLine(line); err != nil {
+		t.Fatal(err)
+	}
+	if ds.Creation.Location() != time.UTC || ds.Creation.Unix() != 1546263000 {
+		t.Fatalf("unexpected creation time: %v", ds.Creation)
+	}
+	if !ds.CreationLocal().Equal(ds.Creation) || ds.CreationLocal().Location() != time.Local {
+		t.Fatalf("unexpected local creation time: %v", ds.CreationLocal())
+	}
+}
+
+func TestModifiedSince(t *testing.T) {
+	since := time.Unix(1000, 0).UTC()
+	before, after := time.Unix(500, 0).UTC(), time.Unix(1500, 0).UTC()
+	datasets := []*Dataset{
+		{Name: "pool/idle", Type: DatasetFilesystem, Creation: before, Written: "0"},
+		{Name: "pool/idle@a", Type: DatasetSnapshot, Creation: before},
+		{Name: "pool/new", Type: DatasetFilesystem, Creation: after, Written: "0"},
+		{Name: "pool/snapped", Type: DatasetFilesystem, Creation: before, Written: "0"},
+		{Name: "pool/snapped@a", Type: DatasetSnapshot, Creation: before},
+		{Name: "pool/snapped@b", Type: DatasetSnapshot, Creation: after},
+		{Name: "pool/dirty", Type: DatasetVolume, Creation: before, Written: "4096"},
+		{Name: "pool/unknown", Type: DatasetFilesystem, Creation: before},
+	}
+	var names []string
+	for _, ds := range modifiedSince(datasets, since) {
+		names = append(names, ds.Name)
+	}
+	expected := []string{"pool/new", "pool/snapped", "pool/dirty", "pool/unknown"}
+	if strings.Join(names, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected %v, got %v", expected, names)
+	}
+}
+
+func TestParseWrittenSince(t *testing.T) {
+	written, err := parseWrittenSince([][]string{
+		{"pool/fs", "4096"},
+		{"pool/fs/child", "0"},
+		{"pool/fs/new", "-"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]uint64{"pool/fs": 4096, "pool/fs/child": 0}
+	if !reflect.DeepEqual(written, expected) {
+		t.Fatalf("expected %v, got %v", expected, written)
+	}
+
+	if _, err := parseWrittenSince([][]string{{"pool/fs", "4K"}}); err == nil {
+		t.Fatalf("expected an error for a non-parsable size")
+	}
+}
+
+func TestValidResumeToken(t *testing.T) {
+	valid := []string{"1-e604ea4bf-e0-789c63a2", "1-10ab3e4b47-f0-789c636064000310a500c4ec50360710e72765a5269740f80cd8e4d3d28a534b18e00024cf86249f5459925acc802a8facbf243fbd34338581e1f5f7b4d93b0c"}
+	for _, token := range valid {
+		if !validResumeToken(token) {
+			t.Errorf("expected %q to be valid", token)
+		}
+	}
+	invalid := []string{"", "pool/fs@snap", "1-e604ea4bf-e0", "1-e604ea4bf-e0-789c63a2 pool/fs", "x-e604ea4bf-e0-789c63a2"}
+	for _, token := range invalid {
+		if validResumeToken(token) {
+			t.Errorf("expected %q to be invalid", token)
+		}
+	}
+
+	zh := NewLocalHandle()
+	err := zh.SendSnapshot("pool/fs@snap", "", nil, SendWithToken, "")
+	if !errors.Is(err, ErrInvalidResumeToken) {
+		t.Fatalf("expected ErrInvalidResumeToken, got: %v", err)
+	}
+}
+
+func TestSendArgs(t *testing.T) {
+	token := "1-e604ea4bf-e0-789c63a2"
+	var tests = []struct {
+		ds0, ds1 string
+		flags    SendFlag
+		extra    []string
+		args     string
+	}{
+		{"pool/fs@b", "", SendDefault, nil, "send pool/fs@b"},
+		{"pool/fs@b", "pool/fs@a", SendIncremental | SendRecursive | SendLz4 | SendProps, nil, "send -R -c -p -i pool/fs@a pool/fs@b"},
+		{"pool/fs@b", "pool/fs@a", SendIncremental | SendIntermediate | SendRaw, []string{"-L"}, "send -w -I pool/fs@a -L pool/fs@b"},
+		{"pool/fs@b", "pool/fs#a", SendIncremental | SendEmbeddedData | SendBackupProps | SendDedup, []string{"-nvP"}, "send -e -b -D -i pool/fs#a -nvP pool/fs@b"},
+		{token, "", SendWithToken, nil, "send -t " + token},
+		{token, "", SendWithToken | SendEmbeddedData, []string{"-v"}, "send -e -v -t " + token},
+	}
+	for _, test := range tests {
+		args, err := sendArgs(test.ds0, test.ds1, test.flags, test.extra)
+		if err != nil {
+			t.Fatalf("unexpected error for %+v: %v", test, err)
+		}
+		if got := strings.Join(args, " "); got != test.args {
+			t.Errorf("expected %q, got %q", test.args, got)
+		}
+	}
+
+	for _, flags := range []SendFlag{SendRecursive, SendLz4, SendRaw, SendProps, SendDedup, SendIncremental} {
+		if _, err := sendArgs(token, "pool/fs@a", SendWithToken|flags, nil); err == nil {
+			t.Errorf("expected an error for SendWithToken with flags %d", flags)
+		}
+	}
+	if _, err := sendArgs("pool/fs@b", "", SendIncremental, nil); err == nil {
+		t.Errorf("expected an error for an incremental send without source")
+	}
+}
+
+func TestParseHolds(t *testing.T) {
+	holds, err := parseHolds(splitTabbed("pool/fs@a\tkeep\tThu Oct 15 10:12 2026\n" +
+		"pool/fs@a\treplication\tThu Oct 15 10:13 2026\n" +
+		"pool/fs/child@a\tkeep\tThu Oct 15 10:12 2026\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]string{
+		"pool/fs@a":       {"keep", "replication"},
+		"pool/fs/child@a": {"keep"},
+	}
+	if !reflect.DeepEqual(holds, expected) {
+		t.Fatalf("expected %v, got %v", expected, holds)
+	}
+
+	if _, err := parseHolds([][]string{{"pool/fs@a", "keep"}}); err == nil {
+		t.Fatalf("expected an error for a short line")
+	}
+}
+
+func TestRunScan(t *testing.T) {
+	zh := NewLocalHandle()
+	var lines []string
+	c := command{Command: "printf", zh: zh}
+	err := c.RunScan(context.Background(), func(line string) error {
+		lines = append(lines, line)
+		return nil
+	}, "a\\tb\\nc\\n")
+	if err != nil || strings.Join(lines, ",") != "a\tb,c" {
+		t.Fatalf("unexpected scan: %q, %v", lines, err)
+	}
+
+	stop := errors.New("stop")
+	n := 0
+	c = command{Command: "yes", zh: zh}
+	err = c.RunScan(context.Background(), func(line string) error {
+		if n++; n == 3 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || n != 3 {
+		t.Fatalf("expected the scan to stop after 3 lines, got %d lines, %v", n, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	c = command{Command: "sleep", zh: zh}
+	if err := c.RunScan(ctx, func(string) error { return nil }, "10"); err != context.DeadlineExceeded {
+		t.Fatalf("expected the deadline to kill the command, got: %v", err)
+	}
+
+	c = command{Command: "false", zh: zh}
+	if err := c.RunScan(context.Background(), func(string) error { return nil }); err == nil {
+		t.Fatalf("expected the command error")
+	}
+}
+
+func TestContextCancel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	zh := NewLocalHandle().WithContext(ctx)
+	c := command{Command: "sleep", zh: zh}
+	start := time.Now()
+	_, err := c.Run("10")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the deadline error, got: %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatalf("command was not killed")
+	}
+
+	c = command{Command: "true", zh: zh}
+	if _, err := c.Run(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a done context to prevent the command, got: %v", err)
+	}
+}
+
+func TestParseSendSize(t *testing.T) {
+	size, err := parseSendSize("incremental\tpool/fs#a\tpool/fs@b\t4120\nsize\t4120\n")
+	if err != nil || size != 4120 {
+		t.Fatalf("unexpected size: %d, %v", size, err)
+	}
+
+	if _, err := parseSendSize("full\tpool/fs@b\t4120\n"); err == nil {
+		t.Fatalf("expected an error without size line")
+	}
+}
+
+func TestParseReadOnlyFeatures(t *testing.T) {
+	usage := "This system supports ZFS pool feature flags.\n\n" +
+		"FEAT DESCRIPTION\n" +
+		"-------------------------------------------------------------\n" +
+		"async_destroy                         (read-only compatible)\n" +
+		"     Destroy filesystems asynchronously.\n" +
+		"lz4_compress\n" +
+		"     LZ4 compression algorithm support.\n\n" +
+		"The following legacy versions are also supported:\n\n" +
+		"VER  DESCRIPTION\n" +
+		"---  --------------------------------------------------------\n" +
+		" 1   Initial ZFS version\n" +
+		"10   Cache devices\n"
+	readOnly := parseReadOnlyFeatures(usage)
+	if len(readOnly) != 2 || !readOnly["async_destroy"] || readOnly["lz4_compress"] {
+		t.Fatalf("unexpected features: %v", readOnly)
+	}
+}
+
+func TestParentName(t *testing.T) {
+	tests := map[string]string{
+		"pool":          "",
+		"pool/fs":       "pool",
+		"pool/fs/child": "pool/fs",
+		"pool/fs@snap":  "pool/fs",
+		"pool/fs#mark":  "pool/fs",
+		"pool@snap":     "pool",
+		"pool/a/b@x/y":  "pool/a/b",
+	}
+	for name, exp := range tests {
+		if got := parentName(name); got != exp {
+			t.Fatalf("parentName(%q): expected %q, got %q", name, exp, got)
+		}
+	}
+}
+
+func TestPoolName(t *testing.T) {
+	tests := map[string]string{
+		"pool":          "pool",
+		"pool/fs/child": "pool",
+		"pool@snap":     "pool",
+		"pool#mark":     "pool",
+	}
+	for name, exp := range tests {
+		if got := poolName(name); got != exp {
+			t.Fatalf("poolName(%q): expected %q, got %q", name, exp, got)
+		}
+	}
+}
+
+func TestInodeArgs(t *testing.T) {
+	dir, err := os.MkdirTemp("", "inodes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "it's a file")
+	if err := os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "missing")
+
+	// ls fails for the missing path, but lists the existing one
+	out, _ := exec.Command("ls", inodeArgs([]string{missing, file}, false)...).Output()
+	inodes, err := parseInodeList(string(out))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(inodes) != 1 || inodes[file] != info.Sys().(*syscall.Stat_t).Ino {
+		t.Fatalf("unexpected inodes: %v", inodes)
+	}
+
+	// quoted for a remote shell
+	out, _ = exec.Command("sh", "-c", "ls "+strings.Join(inodeArgs([]string{file}, true), " ")).Output()
+	inodes, err = parseInodeList(string(out))
+	if err != nil || inodes[file] != info.Sys().(*syscall.Stat_t).Ino {
+		t.Fatalf("unexpected inodes: %v, %v", inodes, err)
+	}
+
+	if _, err := parseInodeList("x /a\n"); err == nil {
+		t.Fatalf("expected an error for an invalid inode")
+	}
+}
+
+func TestParseUnavailableKeyRoots(t *testing.T) {
+	roots, err := parseUnavailableKeyRoots(splitTabbed(
+		"pool\tencryptionroot\t-\npool\tkeylocation\tnone\npool\tkeystatus\t-\n" +
+			"pool/a\tencryptionroot\tpool/a\npool/a\tkeylocation\tprompt\npool/a\tkeystatus\tunavailable\n" +
+			"pool/a/c\tencryptionroot\tpool/a\npool/a/c\tkeylocation\tnone\npool/a/c\tkeystatus\tunavailable\n" +
+			"pool/b\tencryptionroot\tpool/b\npool/b\tkeylocation\tfile:///k\npool/b\tkeystatus\tavailable\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(roots) != 1 || roots[0] != (keyRoot{name: "pool/a", location: "prompt"}) {
+		t.Fatalf("unexpected roots: %#v", roots)
+	}
+
+	if _, err := parseUnavailableKeyRoots([][]string{{"pool", "keystatus"}}); err == nil {
+		t.Fatalf("expected an error for a short line")
+	}
+}
+
+func TestParseReceivedSnapshots(t *testing.T) {
+	names := parseReceivedSnapshots("receiving full stream of pool/src@a into pool/dst@a\n" +
+		"received 46.4K stream in 1 seconds (46.4K/sec)\n" +
+		"receiving incremental stream of pool/src/child@b into pool/dst/child@b\n" +
+		"received 312B stream in 1 seconds (312B/sec)\n")
+	if len(names) != 2 || names[0] != "pool/dst@a" || names[1] != "pool/dst/child@b" {
+		t.Fatalf("unexpected snapshots: %v", names)
+	}
+}
+
+func TestRemapsReceiveName(t *testing.T) {
+	for _, tc := range []struct {
+		extra []string
+		want  bool
+	}{
+		{nil, false},
+		{[]string{"-F"}, false},
+		{[]string{"-d"}, true},
+		{[]string{"-e"}, true},
+		{[]string{"-Fd"}, true},
+		{[]string{"-o", "dedup=on", "-x", "devices"}, false},
+	} {
+		if got := remapsReceiveName(tc.extra); got != tc.want {
+			t.Errorf("remapsReceiveName(%q) = %v, want %v", tc.extra, got, tc.want)
+		}
+	}
+}
+
+func TestParseSnapshotClones(t *testing.T) {
+	snapshots, err := parseSnapshotClones(splitTabbed(
+		"pool/fs@b\tclones\t\npool/fs@b\tcreatetxg\t20\n" +
+			"pool/fs@a\tclones\tpool/c1,pool/c2\npool/fs@a\tcreatetxg\t12\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(snapshots) != 2 || snapshots[0].name != "pool/fs@a" || len(snapshots[0].clones) != 2 ||
+		snapshots[0].clones[1] != "pool/c2" || snapshots[1].clones != nil {
+		t.Fatalf("unexpected snapshots: %#v", snapshots)
+	}
+
+	if _, err := parseSnapshotClones([][]string{{"pool/fs@a", "createtxg", "x"}}); err == nil {
+		t.Fatalf("expected an error for an invalid createtxg")
+	}
+}
+
+func TestParsePropertyTree(t *testing.T) {
+	tree, err := parsePropertyTree(splitTabbed("pool/fs\ttype\tfilesystem\n" +
+		"pool/fs\tcomment\tsome text\npool/fs@snap\ttype\tsnapshot\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(tree) != 2 || tree["pool/fs"]["comment"] != "some text" || tree["pool/fs@snap"]["type"] != "snapshot" {
+		t.Fatalf("unexpected tree: %v", tree)
+	}
+
+	if _, err := parsePropertyTree([][]string{{"pool/fs", "type"}}); err == nil {
+		t.Fatalf("expected an error for a short line")
+	}
+}
+
+func TestParsePropertyValues(t *testing.T) {
+	values, err := parsePropertyValues(splitTabbed(
+		"compression\tlz4\tlocal\nuser:note\t-\t-\nuser:dash\t-\tlocal\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	exp := map[string]string{"compression": "lz4", "user:dash": "-"}
+	if !reflect.DeepEqual(values, exp) {
+		t.Fatalf("expected %v, got %v", exp, values)
+	}
+
+	if _, err := parsePropertyValues([][]string{{"compression", "lz4"}}); err == nil {
+		t.Fatalf("expected an error for a missing column")
+	}
+}
+
+func TestCheckBlockSizes(t *testing.T) {
+	sizes, err := checkBlockSizes(map[string]string{"recordsize": "1m", "volblocksize": "16384", "compression": "lz4"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(sizes) != 2 || sizes["recordsize"] != 1<<20 || sizes["volblocksize"] != 16384 {
+		t.Fatalf("unexpected sizes: %v", sizes)
+	}
+
+	for _, value := range []string{"256", "32M", "96K", "big"} {
+		if _, err := checkBlockSizes(map[string]string{"recordsize": value}); err == nil {
+			t.Fatalf("expected an error for %q", value)
+		}
+	}
+}
+
+func TestParseDedupStatus(t *testing.T) {
+	info, err := parseDedupStatus("  pool: tank\n state: ONLINE\n\n dedup: DDT entries 1234, size 304B on disk, 160B in core\n")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if *info != (DedupInfo{Entries: 1234, EntrySizeOnDisk: 304, EntrySizeInCore: 160}) {
+		t.Fatalf("unexpected info: %+v", info)
+	}
+
+	info, err = parseDedupStatus(" dedup: DDT entries 7, size 512 on disk, 256 in core\n")
+	if err != nil || info.EntrySizeOnDisk != 512 {
+		t.Fatalf("unexpected info for sizes without unit: %+v, %v", info, err)
+	}
+
+	info, err = parseDedupStatus("  pool: tank\n dedup: no DDT entries\n")
+	if err != nil || info.Entries != 0 {
+		t.Fatalf("unexpected info without DDT: %+v, %v", info, err)
+	}
+
+	if _, err := parseDedupStatus("  pool: tank\n"); err == nil {
+		t.Fatalf("expected an error without dedup statistics")
+	}
+}
@@ -2,14 +2,21 @@
 package zfs
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"strconv"
 	"strings"
 	"regexp"
-	"golang.org/x/crypto/ssh"
 	"os/user"
+	"path"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+	"golang.org/x/crypto/ssh"
 )
 
 // ZFS dataset types, which can indicate if a dataset is a filesystem,
@@ -28,20 +35,46 @@ const (
 // The field definitions can be found in the ZFS manual:
 // http://www.freebsd.org/cgi/man.cgi?zfs(8).
 type Dataset struct {
-	Name               string
-	Origin             string
-	Used               string
-	Avail              string
-	Mountpoint         string
-	Compression        string
-	Type               string
-	Written            string
-	Volsize            string
-	Logicalused        string
-	Quota              string
-	ReceiveResumeToken string
-	Compressratio      string
-	Usedbysnapshots    string
+	Name                 string
+	Origin               string
+	Used                 string
+	Avail                string
+	Mountpoint           string
+	Compression          string
+	Type                 string
+	Written              string
+	Volsize              string
+	Logicalused          string
+	Quota                string
+	ReceiveResumeToken   string
+	Compressratio        string
+	Usedbysnapshots      string
+	Readonly             string
+	Usedbydataset        string
+	Usedbychildren       string
+	Usedbyrefreservation string
+	Canmount             string
+	Snapdir              string
+	// Creation is the creation time of the dataset, in UTC.  Order datasets
+	// by Creation (or its Unix time) rather than by a local wall clock
+	// time, which is ambiguous around daylight saving transitions.
+	Creation             time.Time
+	Sync                 string
+	Logbias              string
+	Primarycache         string
+	Secondarycache       string
+	Volmode              string
+}
+
+// SpaceBreakdown is the space accounting of a dataset in bytes, as shown by
+// zfs list -o space.  Used is the sum of the UsedBy fields.
+type SpaceBreakdown struct {
+	Avail                uint64
+	Used                 uint64
+	UsedBySnapshots      uint64
+	UsedByDataset        uint64
+	UsedByChildren       uint64
+	UsedByRefreservation uint64
 }
 
 
@@ -84,6 +117,12 @@ const (
 	DestroyRecursiveClones             = 1 << iota
 	DestroyDeferDeletion               = 1 << iota
 	DestroyForceUmount                 = 1 << iota
+	// DestroyDryRun only reports what would be destroyed (-nv), see
+	// DestroyList.
+	DestroyDryRun                      = 1 << iota
+	// DestroyPromoteClones promotes a clone of the dataset's snapshots
+	// before destroying it, so that the clones survive, see Destroy.
+	DestroyPromoteClones               = 1 << iota
 )
 
 type SendFlag int
@@ -95,9 +134,64 @@ const (
 	SendIntermediate 	= 1 << iota
 	SendLz4		 		= 1 << iota
 	SendEmbeddedData	= 1 << iota
+	// SendWithToken resumes an interrupted send (-t): ds0 is the
+	// receive_resume_token of the partially received dataset, which encodes
+	// the snapshot and the flags of the original send, so that only
+	// SendEmbeddedData may be added.  The token is validated before it is
+	// passed to zfs, see ErrInvalidResumeToken.
 	SendWithToken 		= 1 << iota
+	// SendProps includes the locally set properties in the stream (-p).
+	SendProps		= 1 << iota
+	// SendBackupProps includes only the received properties in the stream
+	// (-b), so that a backup restores the properties the source itself
+	// received rather than those set on the source.  Requires feature
+	// support, see SendFeatures.
+	SendBackupProps		= 1 << iota
+	// SendRaw sends encrypted datasets as is, without decrypting them (-w).
+	// Requires feature support, see SendFeatures.
+	SendRaw			= 1 << iota
+	// SendDedup sends a deduplicated stream (-D).  Deprecated and removed
+	// in recent OpenZFS, where SendLz4 (-c) is the better choice.
+	// Requires feature support, see SendFeatures.
+	SendDedup		= 1 << iota
+	// SendSaved sends the saved, partially received state of the
+	// filesystem or volume ds0 (-S), e.g. to forward an interrupted
+	// receive to another host.  Requires feature support, see
+	// SendFeatures.
+	SendSaved		= 1 << iota
+)
+
+// sendDetectedFlags are the send flags which are checked against the
+// features detected on the host before sending.
+const sendDetectedFlags = SendBackupProps | SendRaw | SendDedup | SendSaved
+
+// ReceiveFlag is the options flag passed to receives in StreamOptions
+type ReceiveFlag int
+
+// Valid receive options
+const (
+	ReceiveDefault ReceiveFlag = 1 << iota
+	// ReceiveNoMount neither mounts the received datasets (-u) nor lets
+	// them be mounted automatically later (-o canmount=noauto), so that
+	// they cannot mount over existing paths of the receiving host.  It
+	// applies to filesystem streams only.
+	ReceiveNoMount             = 1 << iota
 )
 
+// StreamOptions holds optional settings of SendSnapshotWithOptions and
+// ReceiveSnapshotWithOptions.
+type StreamOptions struct {
+	// Stderr receives the standard error of the command as it is written,
+	// e.g. the progress lines of a verbose (-v) send.  The tail of it is
+	// still reported in the returned *Error on failure.  A StderrTail
+	// keeps the last lines of it for display.
+	Stderr io.Writer
+	// ReceiveFlags are applied to receives.
+	ReceiveFlags ReceiveFlag
+	// Operation, if set, follows the progress of the send or receive.
+	Operation *Operation
+}
+
 // InodeChange represents a change as reported by Diff
 type InodeChange struct {
 	Change               ChangeType
@@ -105,6 +199,9 @@ type InodeChange struct {
 	Path                 string
 	NewPath              string
 	ReferenceCountChange int
+	// Inode is the object number of the file, only set by
+	// DiffWithInodes, and 0 when it could not be resolved.
+	Inode uint64
 }
 
 // Logger can be used to log commands/actions
@@ -118,27 +215,138 @@ func (*defaultLogger) Log(cmd []string) {
 	return
 }
 
-var logger Logger = &defaultLogger{}
+var (
+	loggerMu sync.RWMutex
+	logger   Logger = &defaultLogger{}
+)
 
 // SetLogger set a log handler to log all commands including arguments before
-// they are executed
+// they are executed.  It may be called while commands are running.
 func SetLogger(l Logger) {
 	if l != nil {
+		loggerMu.Lock()
 		logger = l
+		loggerMu.Unlock()
+	}
+}
+
+// logLine passes a line to the current logger.
+func logLine(cmd []string) {
+	loggerMu.RLock()
+	l := logger
+	loggerMu.RUnlock()
+	l.Log(cmd)
+}
+
+type operationIDKey struct{}
+
+// WithOperationID returns a copy of ctx carrying id, which commands run
+// through a handle bound to the context with WithContext log instead of a
+// generated ID, so that application logs can reference the same ID.
+func WithOperationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, operationIDKey{}, id)
+}
+
+type operationLabelKey struct{}
+
+// operationLabelEnv is the environment variable commands run with a label
+// carry, so that it shows in their process environment, e.g. with ps e.
+const operationLabelEnv = "ZFS_OPERATION"
+
+// labelRegex matches the characters which are not kept in labels.
+var labelRegex = regexp.MustCompile("[^A-Za-z0-9._:-]")
+
+// WithOperationLabel returns a copy of ctx carrying a human readable label
+// for the commands run through a handle bound to the context with
+// WithContext, such as the name of the job launching them.  The label is
+// passed to the commands in the ZFS_OPERATION environment variable, to tell
+// apart otherwise identical processes, and thus appears in the logged
+// command lines.  The variable is set by running the commands through env,
+// which the sudoers rules must then allow when Sudo is set.  Characters
+// other than letters, digits and ._:- are replaced by underscores.
+func WithOperationLabel(ctx context.Context, label string) context.Context {
+	return context.WithValue(ctx, operationLabelKey{}, labelRegex.ReplaceAllString(label, "_"))
+}
+
+// OperationLabel returns the operation label carried by ctx, or "" if none.
+func OperationLabel(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	label, _ := ctx.Value(operationLabelKey{}).(string)
+	return label
+}
+
+// OperationID returns the operation ID carried by ctx, or "" if none.
+func OperationID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
 	}
+	id, _ := ctx.Value(operationIDKey{}).(string)
+	return id
 }
 
 // zfs handle used to redirect command
 // to local or remote host over ssh
 type ZfsH struct {
-	Local    bool
+	Local bool
+	// Sudo runs zfs and zpool through "sudo -n", for non-root users.
+	Sudo bool
+	// CommandPrefix is prepended to every zfs and zpool invocation,
+	// after sudo when Sudo is set.
+	CommandPrefix []string
+	// NoLocaleOverride leaves the locale of remote commands untouched,
+	// instead of forcing LC_CTYPE and LANG.
+	NoLocaleOverride bool
+	// MaxStderrCapture is the number of bytes at the end of a command's
+	// stderr kept in a returned *Error, 64KB when 0.  A negative value
+	// keeps all of it.
+	MaxStderrCapture int
+	// SSHConfig restricts the ciphers, MACs and key exchanges of the ssh
+	// connection, e.g. for hosts only accepting FIPS approved algorithms.
+	// The defaults of golang.org/x/crypto/ssh apply to the fields left
+	// empty.  It must be set before the connection is first used.
+	SSHConfig ssh.Config
+	// ZfsBinary and ZpoolBinary are the zfs and zpool commands run, e.g.
+	// /usr/local/sbin/zfs when it is not in the PATH of the (remote) user.
+	// They default to "zfs" and "zpool".
+	ZfsBinary   string
+	ZpoolBinary string
+
 	host     string
 	port     int
 	username string
 	password string
 	keyfile  string
 	lz4Send  bool
-	client   *ssh.Client
+	link     *sshLink
+	ctx      context.Context
+}
+
+// WithContext returns a shallow copy of the handle bound to ctx, sharing
+// the ssh connection of the receiving handle.  Commands run through the
+// copy are logged with the operation ID of ctx, see WithOperationID.
+//
+// Commands run through the copy are killed once ctx is done, and fail with
+// an *Error wrapping ctx.Err(), which errors.Is(err, context.Canceled)
+// detects.  Remote commands are sent SIGKILL and their session is closed;
+// ssh servers which ignore signal requests end the process when it next
+// writes to the closed session.
+func (z *ZfsH) WithContext(ctx context.Context) *ZfsH {
+	if ctx == nil {
+		panic("nil context")
+	}
+	zh := *z
+	zh.ctx = ctx
+	return &zh
+}
+
+// context returns the context of the handle, see WithContext.
+func (z *ZfsH) context() context.Context {
+	if z.ctx == nil {
+		return context.Background()
+	}
+	return z.ctx
 }
 
 func (z *ZfsH) Lz4Send() bool {
@@ -148,6 +356,7 @@ func (z *ZfsH) Lz4Send() bool {
 func NewLocalHandle() *ZfsH {
 	return &ZfsH{
 		Local:true,
+		link: &sshLink{},
 	}
 }
 
@@ -157,6 +366,7 @@ func NewSSHHandle(host string, port int, username string, keyfile *string) *ZfsH
 		host: host,
 		port: port,
 		username: username,
+		link: &sshLink{},
 	}
 
 	if (keyfile == nil) {
@@ -169,6 +379,18 @@ func NewSSHHandle(host string, port int, username string, keyfile *string) *ZfsH
 	return zh;
 }
 
+// String returns a short description of the dataset: name (type, used/avail).
+func (d *Dataset) String() string {
+	return fmt.Sprintf("%s (%s, %s/%s)", d.Name, d.Type, d.Used, d.Avail)
+}
+
+// Format implements fmt.Formatter so that %+v and %#v still print all the
+// fields of the dataset.
+func (d *Dataset) Format(f fmt.State, verb rune) {
+	type dataset Dataset
+	formatStringer(f, verb, d, (*dataset)(d))
+}
+
 func (d *Dataset) DataSetName() string {
 	if d.Type == DatasetSnapshot {
 		return strings.Split(d.Name, "@")[1]
@@ -179,6 +401,82 @@ func (d *Dataset) DataSetName() string {
 	return ""
 }
 
+// Jail attaches the receiving filesystem to the FreeBSD jail jailID, so
+// that it can be managed from inside the jail.  The jailed property must be
+// set on the filesystem.  Like the platform specific property lists, this
+// assumes the handle's host runs the same platform as this process;
+// elsewhere ErrUnsupportedPlatform is returned.
+func (z *ZfsH) Jail(d *Dataset, jailID string) error {
+	if runtime.GOOS != "freebsd" {
+		return ErrUnsupportedPlatform
+	}
+	_, err := z.zfs("jail", jailID, d.Name)
+	return err
+}
+
+// Unjail detaches the receiving filesystem from the FreeBSD jail jailID.
+// Elsewhere ErrUnsupportedPlatform is returned.
+func (z *ZfsH) Unjail(d *Dataset, jailID string) error {
+	if runtime.GOOS != "freebsd" {
+		return ErrUnsupportedPlatform
+	}
+	_, err := z.zfs("unjail", jailID, d.Name)
+	return err
+}
+
+// Parent returns the parent dataset of the receiving dataset, or nil when
+// it is a pool root.  The parent of a snapshot or bookmark is the
+// filesystem or volume it belongs to.
+func (z *ZfsH) Parent(d *Dataset) (*Dataset, error) {
+	name := parentName(d.Name)
+	if name == "" {
+		return nil, nil
+	}
+	return z.GetDataset(name)
+}
+
+// SpaceBreakdown returns the space accounting of the dataset.  Bookmarks
+// and snapshots report zero for the fields which do not apply to them.
+func (d *Dataset) SpaceBreakdown() (*SpaceBreakdown, error) {
+	space := &SpaceBreakdown{}
+	for _, f := range []struct {
+		field *uint64
+		value string
+	}{
+		{&space.Avail, d.Avail},
+		{&space.Used, d.Used},
+		{&space.UsedBySnapshots, d.Usedbysnapshots},
+		{&space.UsedByDataset, d.Usedbydataset},
+		{&space.UsedByChildren, d.Usedbychildren},
+		{&space.UsedByRefreservation, d.Usedbyrefreservation},
+	} {
+		if f.value == "" {
+			continue
+		}
+		if err := setUint(f.field, f.value); err != nil {
+			return nil, err
+		}
+	}
+	return space, nil
+}
+
+// IsReadonly reports whether the dataset's readonly property is on.
+func (d *Dataset) IsReadonly() bool {
+	return d.Readonly == "on"
+}
+
+// CreationLocal returns the creation time of the dataset in the local time
+// zone, for display.
+func (d *Dataset) CreationLocal() time.Time {
+	return d.Creation.Local()
+}
+
+// IsClone reports whether the dataset is a filesystem or volume cloned
+// from a snapshot, that is whether its origin property is set.
+func (d *Dataset) IsClone() bool {
+	return d.Origin != "" && (d.Type == DatasetFilesystem || d.Type == DatasetVolume)
+}
+
 func (z *ZfsH) TestLz4SendSupport() {
 	_, err := z.zfs("send","--help")
 	if err != nil {
@@ -188,28 +486,235 @@ func (z *ZfsH) TestLz4SendSupport() {
 	}
 }
 
+// SendFeatureSet describes the optional zfs send flags supported by the zfs
+// binary of a handle.
+type SendFeatureSet struct {
+	options string
+}
+
+// sendFlagOptions maps send flags to the zfs send option they emit, for
+// options which are not available in every zfs version.
+var sendFlagOptions = map[SendFlag]byte{
+	SendLz4:          'c',
+	SendEmbeddedData: 'e',
+	SendProps:        'p',
+	SendBackupProps:  'b',
+	SendRaw:          'w',
+	SendDedup:        'D',
+	SendSaved:        'S',
+}
+
+// Supports reports whether every zfs send option emitted for flag is
+// supported.
+func (f *SendFeatureSet) Supports(flag SendFlag) bool {
+	for sf, opt := range sendFlagOptions {
+		if flag&sf != 0 && strings.IndexByte(f.options, opt) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// SendFeatures detects the zfs send flags supported on the handle's host by
+// parsing the usage of zfs send.  The result is cached on the handle.
+func (z *ZfsH) SendFeatures() (*SendFeatureSet, error) {
+	z.link.Lock()
+	features := z.link.sendFeatures
+	z.link.Unlock()
+	if features != nil {
+		return features, nil
+	}
+
+	_, err := z.zfs("send", "--help")
+	zerr, ok := err.(*Error)
+	if !ok {
+		if err == nil {
+			err = errors.New("zfs send --help did not print its usage")
+		}
+		return nil, err
+	}
+	features = parseSendUsage(zerr.Stderr)
+	if features.options == "" {
+		return nil, err
+	}
+
+	z.link.Lock()
+	z.link.sendFeatures = features
+	z.link.Unlock()
+	return features, nil
+}
+
 func (z *ZfsH) Close() {
-	if (z.client != nil) {
-		z.client.Close()
+	if z.link == nil {
+		return
+	}
+	z.link.Lock()
+	defer z.link.Unlock()
+	if (z.link.client != nil) {
+		z.link.client.Close()
+		z.link.client = nil
 	}
 }
 
+// wrap returns the command line used to invoke bin, including the sudo and
+// command prefixes configured on the handle.
+func (z *ZfsH) wrap(bin string) string {
+	parts := make([]string, 0, len(z.CommandPrefix)+5)
+	if z.Sudo {
+		parts = append(parts, "sudo", "-n")
+	}
+	parts = append(parts, z.CommandPrefix...)
+	if label := OperationLabel(z.ctx); label != "" {
+		parts = append(parts, "env", operationLabelEnv+"="+label)
+	}
+	switch {
+	case bin == "zfs" && z.ZfsBinary != "":
+		bin = z.ZfsBinary
+	case bin == "zpool" && z.ZpoolBinary != "":
+		bin = z.ZpoolBinary
+	}
+	parts = append(parts, bin)
+	return strings.Join(parts, " ")
+}
+
+// commandEnv returns the environment variables set for commands run
+// through the handle.
+func (z *ZfsH) commandEnv() []string {
+	if z.NoLocaleOverride {
+		return nil
+	}
+	return []string{"LC_CTYPE=C", "LANG=en_US.UTF-8"}
+}
+
+// stderrCapture returns the number of stderr bytes kept for error
+// reporting, 0 meaning all of them.
+func (z *ZfsH) stderrCapture() int {
+	switch {
+	case z.MaxStderrCapture < 0:
+		return 0
+	case z.MaxStderrCapture == 0:
+		return stderrTailSize
+	}
+	return z.MaxStderrCapture
+}
+
 // zfs is a helper function to wrap typical calls to zfs.
 func (z *ZfsH) zfs(arg ...string) ([][]string, error) {
 	c := command{
-		Command: "zfs",
+		Command: z.wrap("zfs"),
 		zh: z,
 	}
 	return c.Run(arg...)
 }
 
-// Datasets returns a slice of ZFS datasets, regardless of type.
+// zfsTabbed is like zfs, but splits the lines of -H output on tabs only, so
+// that values containing spaces are preserved.
+func (z *ZfsH) zfsTabbed(arg ...string) ([][]string, error) {
+	out, err := z.zfsOutput(arg...)
+	if err != nil {
+		return nil, err
+	}
+	return splitTabbed(out), nil
+}
+
+// zfsOutput runs zfs and returns its raw standard output.
+func (z *ZfsH) zfsOutput(arg ...string) (string, error) {
+	c := command{
+		Command: z.wrap("zfs"),
+		zh: z,
+	}
+	if _, err := c.Run(arg...); err != nil {
+		return "", err
+	}
+	return c.stdout.String(), nil
+}
+
+// Datasets returns a slice of ZFS datasets of the given types, which may be
+// a single type, a comma-separated list such as "filesystem,volume", or
+// empty string ("") for all types.
 // A filter argument may be passed to select a dataset with the matching name,
 // or empty string ("") may be used to select all datasets.
 func (z *ZfsH) Datasets(datasettype string, filter string, depth int, recurse bool) ([]*Dataset, error) {
+	if datasettype == "" {
+		datasettype = "all"
+	}
 	return z.listByType(datasettype, filter, depth, recurse)
 }
 
+// DatasetsChan is like Datasets, but sends each dataset on the returned
+// channel as soon as zfs lists it, so that large inventories can be
+// processed without holding them in memory.  filter and its descendants up
+// to depth, -1 for all, are listed.  The dataset channel is closed when
+// the listing ends; the error channel then yields the error which ended it,
+// if any, including ctx.Err() when ctx is done first, and is closed too.
+func (z *ZfsH) DatasetsChan(ctx context.Context, datasettype, filter string, depth int) (<-chan *Dataset, <-chan error) {
+	if datasettype == "" {
+		datasettype = "all"
+	}
+	datasets := make(chan *Dataset)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		defer close(datasets)
+		c := command{
+			Command: z.wrap("zfs"),
+			zh: z,
+		}
+		err := c.RunScan(ctx, func(line string) error {
+			fields := strings.Split(line, "\t")
+			ds := &Dataset{Name: fields[0]}
+			if err := ds.parseLine(fields); err != nil {
+				return err
+			}
+			select {
+			case datasets <- ds:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}, listArgs(datasettype, filter, depth, true)...)
+		if err != nil {
+			errs <- err
+		}
+	}()
+	return datasets, errs
+}
+
+// Walk calls fn for the filesystem or volume root and each of its
+// descendent filesystems and volumes, parents before their children, as
+// zfs lists them, without holding the whole tree in memory.  If fn returns
+// SkipTree, the descendants of the dataset it was called with are skipped;
+// any other error stops the walk and is returned.
+func (z *ZfsH) Walk(root string, fn func(d *Dataset) error) error {
+	c := command{
+		Command: z.wrap("zfs"),
+		zh: z,
+	}
+	skip := ""
+	return c.RunScan(z.context(), func(line string) error {
+		fields := strings.Split(line, "\t")
+		if skip != "" && strings.HasPrefix(fields[0], skip) {
+			return nil
+		}
+		ds := &Dataset{Name: fields[0]}
+		if err := ds.parseLine(fields); err != nil {
+			return err
+		}
+		err := fn(ds)
+		if err == SkipTree {
+			skip = ds.Name + "/"
+			return nil
+		}
+		return err
+	}, listArgs("filesystem,volume", root, -1, true)...)
+}
+
+// DatasetsOfTypes is like Datasets, taking the types as separate values,
+// e.g. DatasetsOfTypes("", -1, true, DatasetFilesystem, DatasetVolume).
+func (z *ZfsH) DatasetsOfTypes(filter string, depth int, recurse bool, types ...string) ([]*Dataset, error) {
+	return z.Datasets(strings.Join(types, ","), filter, depth, recurse)
+}
+
 // Snapshots returns a slice of ZFS snapshots.
 // A filter argument may be passed to select a snapshot with the matching name,
 // or empty string ("") may be used to select all snapshots.
@@ -238,10 +743,55 @@ func (z *ZfsH) Volumes(filter string, depth int) ([]*Dataset, error) {
 	return z.listByType(DatasetVolume, filter, depth, false)
 }
 
+// PartialReceives returns a slice of filesystems and volumes left behind by
+// an interrupted resumable receive, i.e. having a receive_resume_token.
+// These can either be resumed with SendWithToken or discarded with
+// AbortReceive.
+func (z *ZfsH) PartialReceives() ([]*Dataset, error) {
+	datasets, err := z.listByType("filesystem,volume", "", -1, false)
+	if err != nil {
+		return nil, err
+	}
+	var partial []*Dataset
+	for _, ds := range datasets {
+		if ds.ReceiveResumeToken != "" {
+			partial = append(partial, ds)
+		}
+	}
+	return partial, nil
+}
+
+// DatasetsModifiedSince returns the filesystems and volumes which may have
+// been modified since t, so that backup schedulers can skip idle ones.  zfs
+// does not record a modification time, so a dataset is considered modified
+// when any of the following holds:
+//
+//   - it was created after t;
+//   - its newest snapshot was created after t;
+//   - data was written to it since its newest snapshot, or it has no
+//     snapshot and holds data (written is not 0).
+//
+// The last rule cannot tell when the data was written, so the heuristic
+// errs on the side of returning datasets which were not modified; it never
+// omits one which was, as long as the clock of the host is sane.
+func (z *ZfsH) DatasetsModifiedSince(t time.Time) ([]*Dataset, error) {
+	datasets, err := z.listByType("filesystem,volume,snapshot", "", -1, false)
+	if err != nil {
+		return nil, err
+	}
+	return modifiedSince(datasets, t), nil
+}
+
 // GetDataset retrieves a single ZFS dataset by name.  This dataset could be
 // any valid ZFS dataset type, such as a clone, filesystem, snapshot, bookmark or volume.
 func (z *ZfsH) GetDataset(name string) (*Dataset, error) {
-	out, err := z.zfs("list", "-Hp", "-o", strings.Join(DsPropList, ","), name)
+	args := []string{"list", "-Hp", "-o", strings.Join(DsPropList, ",")}
+	if strings.Contains(name, "#") {
+		// bookmarks are only listed when asked for explicitly
+		args = append(args, "-t", DatasetBookmark)
+	}
+	args = append(args, name)
+	out, err := z.zfs(args...)
 	if err != nil {
 		return nil, err
 	}
@@ -299,6 +849,9 @@ func (z *ZfsH) Mount(d *Dataset, overlay bool, options []string) (*Dataset, erro
 	if d.Type == DatasetSnapshot {
 		return nil, errors.New("cannot mount snapshots")
 	}
+	if d.Mountpoint == "legacy" {
+		return nil, fmt.Errorf("%s: %w, use MountLegacy", d.Name, ErrLegacyMountpoint)
+	}
 	args := make([]string, 1, 5)
 	args[0] = "mount"
 	if overlay {
@@ -316,7 +869,73 @@ func (z *ZfsH) Mount(d *Dataset, overlay bool, options []string) (*Dataset, erro
 	return z.GetDataset(d.Name)
 }
 
-// Mount mounts ZFS file systems.
+// SnapshotPath returns the path below the .zfs/snapshot directory of the
+// mounted parent filesystem, through which the contents of the receiving
+// snapshot can be read without cloning it.
+func (z *ZfsH) SnapshotPath(d *Dataset) (string, error) {
+	if d.Type != DatasetSnapshot {
+		return "", errors.New("can only resolve the path of snapshots")
+	}
+	fs, err := z.Parent(d)
+	if err != nil {
+		return "", err
+	}
+	if fs.Type != DatasetFilesystem {
+		return "", fmt.Errorf("%s: snapshots of a %s have no path", d.Name, fs.Type)
+	}
+	if !strings.HasPrefix(fs.Mountpoint, "/") {
+		return "", fmt.Errorf("%s: cannot resolve mountpoint %q", fs.Name, fs.Mountpoint)
+	}
+	mounted, err := z.GetProperty(fs, "mounted")
+	if err != nil {
+		return "", err
+	}
+	if mounted != "yes" {
+		return "", fmt.Errorf("%s: filesystem is not mounted", fs.Name)
+	}
+	return path.Join(fs.Mountpoint, ".zfs", "snapshot", d.DataSetName()), nil
+}
+
+// MountLegacy mounts a ZFS file system with a legacy mountpoint on target,
+// using mount -t zfs with the given mount options.
+func (z *ZfsH) MountLegacy(d *Dataset, target string, options []string) error {
+	if d.Type == DatasetSnapshot {
+		return errors.New("cannot mount snapshots")
+	}
+	args := make([]string, 2, 6)
+	args[0] = "-t"
+	args[1] = "zfs"
+	if options != nil {
+		args = append(args, "-o")
+		args = append(args, strings.Join(options, ","))
+	}
+	args = append(args, d.Name, target)
+	c := command{
+		Command: z.wrap("mount"),
+		zh: z,
+	}
+	_, err := c.Run(args...)
+	return err
+}
+
+// SetMountpoint sets the mountpoint of the receiving dataset, and updates
+// d.Mountpoint accordingly.  Setting it to "legacy" leaves mounting to
+// MountLegacy or /etc/fstab, and Mount will then refuse the dataset.
+func (z *ZfsH) SetMountpoint(d *Dataset, mp string) error {
+	if mp != "legacy" && mp != "none" && !strings.HasPrefix(mp, "/") {
+		return fmt.Errorf("invalid mountpoint %q: must be an absolute path, legacy or none", mp)
+	}
+	if err := z.SetProperty(d, "mountpoint", mp); err != nil {
+		return err
+	}
+	d.Mountpoint = mp
+	return nil
+}
+
+// AbortReceive discards the partially received state of name left by an
+// interrupted resumable receive, along with its receive_resume_token, so
+// that the transfer can no longer be resumed.  To interrupt a receive but
+// keep its state, see ReceiveSnapshotCancellable.
 func (z *ZfsH) AbortReceive(name string) (*Dataset, error) {
 	args := make([]string, 1, 5)
 	args[0] = "receive"
@@ -332,18 +951,91 @@ func (z *ZfsH) AbortReceive(name string) (*Dataset, error) {
 // ReceiveSnapshot receives a ZFS stream from the input io.Reader, creates a
 // new snapshot with the specified name, and streams the input data into the
 // newly-created snapshot.
-// name destination dataset name
+// The receive is resumable (-s).  For a recursive stream, an interrupted
+// receive leaves a resume token on the dataset it was receiving only, see
+// ResumeRecursiveReceive.
+// name destination dataset name, or its parent with -d/-e
 // uncompress uncompress prog if != "" (ex. lzop -d)
-func (z *ZfsH) ReceiveSnapshot(input io.Reader, name, uncompress string, props []string) (*Dataset, error) {
+// extra raw zfs receive arguments, added before the dataset name
+func (z *ZfsH) ReceiveSnapshot(input io.Reader, name, uncompress string, props []string, extra ...string) (*Dataset, error) {
+	return z.ReceiveSnapshotWithOptions(input, name, uncompress, props, nil, extra...)
+}
+
+// ReceiveSnapshotWithOptions receives a ZFS stream like ReceiveSnapshot,
+// honouring the given options, which may be nil.
+//
+// Unless the stream is compressed, its header is inspected to handle
+// encryption: a non-raw stream received below an encrypted parent inherits
+// the parent's encryption, and a stream which zfs refuses to receive into an
+// existing destination because of its encryption yields ErrEncryptionMismatch.
+//
+// When extra contains -d or -e, the stream is received below name, under a
+// name derived from the sent snapshot's.  The dataset actually created is
+// then returned, as reported by zfs receive -v; for a recursive stream this
+// is the top of the received tree.
+func (z *ZfsH) ReceiveSnapshotWithOptions(input io.Reader, name, uncompress string, props []string, opts *StreamOptions, extra ...string) (*Dataset, error) {
+	remapped := remapsReceiveName(extra)
+	out, err := z.receive(input, name, uncompress, props, opts, remapped, extra)
+	if err != nil {
+		return nil, err
+	}
+	if remapped {
+		names := parseReceivedSnapshots(out)
+		if len(names) == 0 {
+			return nil, fmt.Errorf("Unexpected zfs receive output: %q", out)
+		}
+		name = strings.SplitN(names[0], "@", 2)[0]
+	}
+	return z.GetDataset(name)
+}
+
+// ReceiveStream receives a ZFS stream like ReceiveSnapshotWithOptions, and
+// returns all snapshots written by it, as reported by zfs receive -v.  For
+// a recursive or intermediate stream, these span several datasets or
+// snapshots, in the order they were received.
+func (z *ZfsH) ReceiveStream(input io.Reader, name, uncompress string, props []string, opts *StreamOptions, extra ...string) ([]*Dataset, error) {
+	out, err := z.receive(input, name, uncompress, props, opts, true, extra)
+	if err != nil {
+		return nil, err
+	}
+	names := parseReceivedSnapshots(out)
+	received := make([]*Dataset, 0, len(names))
+	for _, snapName := range names {
+		ds, err := z.GetDataset(snapName)
+		if err != nil {
+			return nil, err
+		}
+		received = append(received, ds)
+	}
+	return received, nil
+}
+
+// receive runs zfs receive, returning its standard output when verbose.
+func (z *ZfsH) receive(input io.Reader, name, uncompress string, props []string, opts *StreamOptions, verbose bool, extra []string) (string, error) {
+	if err := checkExtraArgs(extra); err != nil {
+		return "", err
+	}
+	if opts == nil {
+		opts = &StreamOptions{}
+	}
+	input = opts.Operation.countReader(input)
+
+	var encryptionArgs []string
+	if uncompress == "" {
+		encryptionArgs, input = z.receiveEncryptionArgs(input, name, remapsReceiveName(extra))
+	}
 
+	var stdout bytes.Buffer
 	c := command{
-		Command: "zfs",
+		Command: z.wrap("zfs"),
 		Stdin: input,
+		Stdout: &stdout,
+		Stderr: opts.Stderr,
 		zh: z,
 	}
 
 	if uncompress != "" {
-		c.Command = uncompress+"|zfs"
+		c.Command = uncompress+"|"+z.wrap("zfs")
 	}
 	args := make([]string, 1,5)
 	args[0] = "receive"
@@ -354,14 +1046,19 @@ func (z *ZfsH) ReceiveSnapshot(input io.Reader, name, uncompress string, props [
 			args = append(args, prop)
 		}
 	}
+	if opts.ReceiveFlags&ReceiveNoMount != 0 {
+		args = append(args, "-u", "-o", "canmount=noauto")
+	}
 	args = append(args, "-s")
+	if verbose {
+		args = append(args, "-v")
+	}
+	args = append(args, encryptionArgs...)
+	args = append(args, extra...)
 	args = append(args, name)
 
 	_, err := c.Run(args...)
-	if err != nil {
-		return nil, err
-	}
-	return z.GetDataset(name)
+	return stdout.String(), classifyError(err, ErrEncryptionMismatch, encryptionMismatchPatterns...)
 }
 
 // SendSnapshot sends a ZFS stream of a snapshot to the input io.Writer.
@@ -369,61 +1066,121 @@ func (z *ZfsH) ReceiveSnapshot(input io.Reader, name, uncompress string, props [
 // ds0 source snapshot
 // ds1 previous snapshot used when sendflags is SendIncremental
 // compression prog to pipe through if != "" (ex. lzop)
-func (z *ZfsH) SendSnapshot(ds0, ds1 string, output io.Writer, sendflags SendFlag, compress string) error {
-	if sendflags&SendWithToken == 0 && !strings.ContainsAny(ds0, "@") {
-		return errors.New("can only send snapshots")
-	}
+// extra raw zfs send arguments, added before the snapshot name
+func (z *ZfsH) SendSnapshot(ds0, ds1 string, output io.Writer, sendflags SendFlag, compress string, extra ...string) error {
+	return z.SendSnapshotWithOptions(ds0, ds1, output, sendflags, compress, nil, extra...)
+}
 
-	c := command{
-		Command: "zfs",
-		Stdout: output,
-		zh: z,
+// notSnapshotError returns the error for sending a dataset which is not a
+// snapshot, suggesting its most recent snapshot if it has any.
+func (z *ZfsH) notSnapshotError(name string) error {
+	snapshots, err := z.snapshotGuids(name)
+	if err != nil || len(snapshots) == 0 {
+		return fmt.Errorf("can only send snapshots: %s is not a snapshot", name)
 	}
+	return fmt.Errorf("can only send snapshots: %s is not a snapshot; did you mean %s?",
+		name, snapshots[len(snapshots)-1].name)
+}
 
-	args := make([]string, 1,5)
-	args[0] = "send"
+// SendSnapshotWithOptions sends a ZFS stream like SendSnapshot, honouring the
+// given options, which may be nil.
+func (z *ZfsH) SendSnapshotWithOptions(ds0, ds1 string, output io.Writer, sendflags SendFlag, compress string, opts *StreamOptions, extra ...string) error {
+	return z.send(ds0, ds1, output, sendflags, compress, opts, nil, extra)
+}
 
-	if sendflags&SendRecursive != 0 {
-		args = append(args, "-R")
+// send runs zfs send for SendSnapshotWithOptions, killing it when cancel is
+// closed.
+func (z *ZfsH) send(ds0, ds1 string, output io.Writer, sendflags SendFlag, compress string, opts *StreamOptions, cancel <-chan struct{}, extra []string) error {
+	if sendflags&SendWithToken == 0 && sendflags&SendSaved == 0 && !strings.ContainsAny(ds0, "@") {
+		return z.notSnapshotError(ds0)
+	}
+	if err := checkExtraArgs(extra); err != nil {
+		return err
+	}
+	args, err := sendArgs(ds0, ds1, sendflags, extra)
+	if err != nil {
+		return err
+	}
+	if sendflags&sendDetectedFlags != 0 {
+		features, err := z.SendFeatures()
+		if err != nil {
+			return err
+		}
+		if sendflags&SendDedup != 0 && !features.Supports(SendDedup) {
+			return fmt.Errorf("%w: zfs send -D, use SendLz4 (-c) instead", ErrFeatureUnsupported)
+		}
+		if !features.Supports(sendflags & sendDetectedFlags) {
+			return ErrFeatureUnsupported
+		}
+	}
+	if opts == nil {
+		opts = &StreamOptions{}
 	}
 
-	if sendflags&SendLz4 != 0 {
-		args = append(args, "-c")
+	c := command{
+		Command: z.wrap("zfs"),
+		Stdout: opts.Operation.countWriter(output),
+		Stderr: opts.Stderr,
+		zh: z,
+		cancel: cancel,
 	}
 
-	if sendflags&SendWithToken != 0 {
-		args = append(args, "-t")
+	if compress != "" {
+		args = append(args, "|", compress)
 	}
 
-	if sendflags&SendEmbeddedData != 0 {
-		args = append(args, "-e")
+	_, err = c.Run(args...)
+	if sendflags&SendWithToken != 0 {
+		err = classifyError(err, ErrInvalidResumeToken, "resume token is corrupt", "invalid resume token", "bad resume token")
 	}
+	return err
+}
 
-	if sendflags&SendIncremental != 0 {
-		if ds1 == "" {
-			return errors.New("Source snapshot must be set for incremental send")
-		}
+// EstimateSendSize returns the estimated size in bytes of the stream
+// SendSnapshot would produce for the same arguments, using a dry run
+// (zfs send -nvP) with the same send flags.  The incremental base ds1 may be
+// a bookmark, in which case it must exist and SendIntermediate cannot be
+// used.
+func (z *ZfsH) EstimateSendSize(ds0, ds1 string, sendflags SendFlag) (uint64, error) {
+	if sendflags&SendIncremental != 0 && strings.Contains(ds1, "#") {
 		if sendflags&SendIntermediate != 0 {
-			args = append(args, "-I", ds1)
-		} else {
-			args = append(args, "-i", ds1)
+			return 0, errors.New("cannot send intermediate snapshots from a bookmark")
+		}
+		if _, err := z.GetDataset(ds1); err != nil {
+			return 0, fmt.Errorf("bookmark %s does not exist: %v", ds1, err)
 		}
 	}
-	args = append(args, ds0)
-
-	if compress != "" {
-		args = append(args, "|", compress)
+	args, err := sendArgs(ds0, ds1, sendflags, []string{"-nvP"})
+	if err != nil {
+		return 0, err
 	}
 
-	_, err := c.Run(args...)
-	return err
+	// depending on the zfs version the estimate is printed on stdout or
+	// on stderr
+	var stdout, stderr bytes.Buffer
+	c := command{
+		Command: z.wrap("zfs"),
+		Stdout: &stdout,
+		Stderr: &stderr,
+		zh: z,
+	}
+	if _, err := c.Run(args...); err != nil {
+		return 0, err
+	}
+	return parseSendSize(stdout.String() + stderr.String())
 }
 
 // CreateVolume creates a new ZFS volume with the specified name, size, and
 // properties.
+// A recordsize or volblocksize is validated before creating the dataset,
+// and verified on the created dataset.
 // A full list of available ZFS properties may be found here:
 // https://www.freebsd.org/cgi/man.cgi?zfs(8).
 func (z *ZfsH) CreateVolume(name string, size uint64, properties map[string]string) (*Dataset, error) {
+	blockSizes, err := checkBlockSizes(properties)
+	if err != nil {
+		return nil, err
+	}
 	args := make([]string, 4, 5)
 	args[0] = "create"
 	args[1] = "-p"
@@ -433,22 +1190,153 @@ func (z *ZfsH) CreateVolume(name string, size uint64, properties map[string]stri
 		args = append(args, propsSlice(properties)...)
 	}
 	args = append(args, name)
-	_, err := z.zfs(args...)
+	_, err = z.zfs(args...)
 	if err != nil {
 		return nil, err
 	}
-	return z.GetDataset(name)
+	return z.getCreated(name, blockSizes)
+}
+
+// getCreated returns the newly created dataset, after verifying that its
+// block sizes are the requested ones.
+func (z *ZfsH) getCreated(name string, blockSizes map[string]uint64) (*Dataset, error) {
+	ds, err := z.GetDataset(name)
+	if err != nil {
+		return nil, err
+	}
+	for prop, size := range blockSizes {
+		value, err := z.GetProperty(ds, prop)
+		if err != nil {
+			return nil, err
+		}
+		if value != strconv.FormatUint(size, 10) {
+			return nil, fmt.Errorf("%s: %s is %s instead of %d", name, prop, value, size)
+		}
+	}
+	return ds, nil
 }
 
 // Destroy destroys a ZFS dataset. If the destroy bit flag is set, any
 // descendents of the dataset will be recursively destroyed, including snapshots.
 // If the deferred bit flag is set, the snapshot is marked for deferred
 // deletion.
+//
+// If the DestroyPromoteClones bit flag is set and snapshots of the
+// filesystem or volume have clones elsewhere, the youngest clone of the
+// newest such snapshot is promoted first, taking over that snapshot and all
+// older ones, so that the dataset no longer has dependents and can be
+// destroyed along with its remaining snapshots.  This is an advanced
+// operation, which may take long and moves snapshots to the promoted clone.
+// A snapshot cannot be freed of its clones this way, as promoting a clone
+// only moves the snapshot to it.  Together with DestroyDryRun nothing is
+// promoted, and the dry run reports the destroy as if no clone had been.
 func (z *ZfsH) Destroy(d *Dataset, flags DestroyFlag) error {
-	args := make([]string, 1, 3)
-	args[0] = "destroy"
-	if flags&DestroyRecursive != 0 {
-		args = append(args, "-r")
+	if flags&DestroyPromoteClones != 0 && flags&DestroyDryRun == 0 {
+		if err := z.promoteClones(d); err != nil {
+			return err
+		}
+	}
+	_, err := z.DestroyList(d, flags)
+	return err
+}
+
+// promoteClones promotes the youngest clone of the newest snapshot of d
+// having clones outside of d.
+func (z *ZfsH) promoteClones(d *Dataset) error {
+	if d.Type == DatasetSnapshot || d.Type == DatasetBookmark {
+		return fmt.Errorf("%s: cannot promote clones of a %s before destroying it", d.Name, d.Type)
+	}
+	snapshots, err := z.snapshotClones(d.Name)
+	if err != nil {
+		return err
+	}
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		var outside []string
+		for _, clone := range snapshots[i].clones {
+			if clone != d.Name && !strings.HasPrefix(clone, d.Name+"/") {
+				outside = append(outside, clone)
+			}
+		}
+		if len(outside) == 0 {
+			continue
+		}
+		out, err := z.zfs(append([]string{"list", "-Hp", "-s", "createtxg", "-o", "name"}, outside...)...)
+		if err != nil {
+			return err
+		}
+		return z.Promote(&Dataset{Name: out[len(out)-1][0]})
+	}
+	return nil
+}
+
+// snapshotClones returns the snapshots of the named dataset, or the named
+// snapshot itself, along with their clones, oldest first.
+func (z *ZfsH) snapshotClones(name string) ([]snapshotClones, error) {
+	out, err := z.zfsTabbed("get", "-Hp", "-d", "1", "-t", DatasetSnapshot, "-o", "name,property,value", "clones,createtxg", name)
+	if err != nil {
+		return nil, err
+	}
+	return parseSnapshotClones(out)
+}
+
+// Clones returns the names of the clones of the receiving snapshot.  For a
+// filesystem or volume, the clones of all its snapshots are returned.
+func (z *ZfsH) Clones(d *Dataset) ([]string, error) {
+	if d.Type == DatasetBookmark {
+		return nil, errors.New("bookmarks have no clones")
+	}
+	snapshots, err := z.snapshotClones(d.Name)
+	if err != nil {
+		return nil, err
+	}
+	var clones []string
+	for _, snapshot := range snapshots {
+		clones = append(clones, snapshot.clones...)
+	}
+	return clones, nil
+}
+
+// Origins returns the origin snapshots the receiving dataset depends on,
+// nearest first: its origin, the origin of the filesystem that snapshot
+// belongs to, and so on.  A dataset which is not a clone has none.
+func (z *ZfsH) Origins(d *Dataset) ([]string, error) {
+	var origins []string
+	for d.IsClone() {
+		origins = append(origins, d.Origin)
+		var err error
+		if d, err = z.GetDataset(parentName(d.Origin)); err != nil {
+			return origins, err
+		}
+	}
+	return origins, nil
+}
+
+// HasClones reports whether the receiving snapshot, or any snapshot of the
+// receiving filesystem or volume, has clones.
+func (z *ZfsH) HasClones(d *Dataset) (bool, error) {
+	clones, err := z.Clones(d)
+	return len(clones) != 0, err
+}
+
+// Promote promotes the receiving clone, so that it no longer depends on its
+// origin snapshot, which is moved to it along with all older snapshots.
+func (z *ZfsH) Promote(d *Dataset) error {
+	_, err := z.zfs("promote", d.Name)
+	return err
+}
+
+// DestroyList destroys a ZFS dataset like Destroy, and returns the names of
+// the datasets that were destroyed.  For recursive destroys the list is
+// gathered by a dry run (zfs destroy -nv) before anything is destroyed, so
+// with DestroyRecursiveClones it includes dependent clones living elsewhere
+// in the tree.  The list is returned even if the destroy itself fails.
+// With DestroyDryRun nothing is destroyed, and the list holds the datasets
+// which would have been.
+func (z *ZfsH) DestroyList(d *Dataset, flags DestroyFlag) ([]string, error) {
+	args := make([]string, 1, 3)
+	args[0] = "destroy"
+	if flags&DestroyRecursive != 0 {
+		args = append(args, "-r")
 	}
 
 	if flags&DestroyRecursiveClones != 0 {
@@ -464,8 +1352,61 @@ func (z *ZfsH) Destroy(d *Dataset, flags DestroyFlag) error {
 	}
 
 	args = append(args, d.Name)
+
+	destroyed := []string{d.Name}
+	if flags&(DestroyRecursive|DestroyRecursiveClones|DestroyDryRun) != 0 {
+		dryRun := append([]string{"destroy", "-nvp"}, args[1:]...)
+		out, err := z.zfs(dryRun...)
+		if err != nil {
+			return nil, err
+		}
+		destroyed, _ = parseDestroyOutput(out)
+		if flags&DestroyDryRun != 0 {
+			return destroyed, nil
+		}
+	}
+
 	_, err := z.zfs(args...)
-	return err
+	return destroyed, err
+}
+
+// SnapshotRangeReclaim returns the space in bytes which destroying the
+// snapshots of the receiving dataset from first to last, inclusive, would
+// free (zfs destroy -nvp fs@first%last).  Blocks shared only by snapshots of
+// the range are counted, so that the total may be far more than the sum of
+// the space each snapshot would free on its own.  first and last are short
+// snapshot names, either may be empty to start from the oldest or end at
+// the newest snapshot.
+func (z *ZfsH) SnapshotRangeReclaim(d *Dataset, first, last string) (uint64, error) {
+	if d.Type != DatasetFilesystem && d.Type != DatasetVolume {
+		return 0, fmt.Errorf("%s is not a filesystem or volume", d.Name)
+	}
+	first, last = strings.TrimPrefix(first, "@"), strings.TrimPrefix(last, "@")
+	if strings.ContainsAny(first+last, "@#/%") {
+		return 0, fmt.Errorf("invalid snapshot range %q to %q", first, last)
+	}
+	out, err := z.zfs("destroy", "-nvp", d.Name+"@"+first+"%"+last)
+	if err != nil {
+		return 0, err
+	}
+	_, reclaim := parseDestroyOutput(out)
+	return reclaim, nil
+}
+
+// WrittenSinceRecursive returns the bytes written to the receiving dataset
+// and each of its descendants since their snapshot of the given short name,
+// keyed by dataset name, e.g. to size a recursive incremental send.
+// Descendants without that snapshot are left out.
+func (z *ZfsH) WrittenSinceRecursive(d *Dataset, snapshot string) (map[string]uint64, error) {
+	snapshot = strings.TrimPrefix(snapshot, "@")
+	if snapshot == "" || strings.ContainsAny(snapshot, "@#/") {
+		return nil, fmt.Errorf("invalid snapshot name %q", snapshot)
+	}
+	out, err := z.zfs("get", "-Hp", "-r", "-t", "filesystem,volume", "-o", "name,value", "written@"+snapshot, d.Name)
+	if err != nil {
+		return nil, err
+	}
+	return parseWrittenSince(out)
 }
 
 // SetProperty sets a ZFS property on the receiving dataset.
@@ -477,37 +1418,482 @@ func (z *ZfsH) SetProperty(d *Dataset, key, val string) error {
 	return err
 }
 
+// SetProperties sets several ZFS properties on the receiving dataset with a
+// single zfs set, so that either all or none of them are set.  Keys may not
+// be empty or contain "=", while values may.
+func (z *ZfsH) SetProperties(d *Dataset, props map[string]string) error {
+	if len(props) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(props))
+	for key := range props {
+		if key == "" || strings.Contains(key, "=") {
+			return fmt.Errorf("invalid property name %q", key)
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	args := make([]string, 0, len(keys)+2)
+	args = append(args, "set")
+	for _, key := range keys {
+		args = append(args, key+"="+props[key])
+	}
+	args = append(args, d.Name)
+	_, err := z.zfs(args...)
+	return err
+}
+
+// SetCanmount sets the canmount property of the receiving dataset, which
+// must be "on", "off" or "noauto", and updates d.Canmount accordingly.  A
+// noauto dataset is only mounted explicitly, e.g. with Mount.
+func (z *ZfsH) SetCanmount(d *Dataset, mode string) error {
+	switch mode {
+	case "on", "off", "noauto":
+	default:
+		return fmt.Errorf("invalid canmount value %q: must be on, off or noauto", mode)
+	}
+	if err := z.SetProperty(d, "canmount", mode); err != nil {
+		return err
+	}
+	d.Canmount = mode
+	return nil
+}
+
+// setEnumProperty sets the property key of the receiving dataset to mode,
+// which must be one of allowed, and then stores it in field.
+func (z *ZfsH) setEnumProperty(d *Dataset, key, mode string, field *string, allowed ...string) error {
+	valid := false
+	for _, value := range allowed {
+		valid = valid || mode == value
+	}
+	if !valid {
+		return fmt.Errorf("invalid %s value %q: must be one of %s", key, mode, strings.Join(allowed, ", "))
+	}
+	if err := z.SetProperty(d, key, mode); err != nil {
+		return err
+	}
+	*field = mode
+	return nil
+}
+
+// SetSync sets the sync property of the receiving dataset, which must be
+// "standard", "always" or "disabled", and updates d.Sync accordingly.
+func (z *ZfsH) SetSync(d *Dataset, mode string) error {
+	return z.setEnumProperty(d, "sync", mode, &d.Sync, "standard", "always", "disabled")
+}
+
+// SetLogbias sets the logbias property of the receiving dataset, which must
+// be "latency" or "throughput", and updates d.Logbias accordingly.
+func (z *ZfsH) SetLogbias(d *Dataset, mode string) error {
+	return z.setEnumProperty(d, "logbias", mode, &d.Logbias, "latency", "throughput")
+}
+
+// SetPrimaryCache sets the primarycache property of the receiving dataset,
+// which must be "all", "none" or "metadata", and updates d.Primarycache
+// accordingly.
+func (z *ZfsH) SetPrimaryCache(d *Dataset, mode string) error {
+	return z.setEnumProperty(d, "primarycache", mode, &d.Primarycache, "all", "none", "metadata")
+}
+
+// SetSecondaryCache sets the secondarycache property of the receiving
+// dataset, which must be "all", "none" or "metadata", and updates
+// d.Secondarycache accordingly.
+func (z *ZfsH) SetSecondaryCache(d *Dataset, mode string) error {
+	return z.setEnumProperty(d, "secondarycache", mode, &d.Secondarycache, "all", "none", "metadata")
+}
+
+// SetVolmode sets the volmode property of the receiving volume, which must
+// be "default", "full", "geom", "dev" or "none", and updates d.Volmode
+// accordingly.  With "dev", the host does not scan the volume for
+// partitions, e.g. for the disks of virtual machines.
+func (z *ZfsH) SetVolmode(d *Dataset, mode string) error {
+	if d.Type != DatasetVolume {
+		return fmt.Errorf("%s is not a volume", d.Name)
+	}
+	return z.setEnumProperty(d, "volmode", mode, &d.Volmode, "default", "full", "geom", "dev", "none")
+}
+
+// SetSnapdir sets the snapdir property of the receiving dataset, making the
+// .zfs directory, through which SnapshotPath reads snapshots, visible in
+// directory listings of the filesystem root or hidden, and updates
+// d.Snapdir accordingly.
+func (z *ZfsH) SetSnapdir(d *Dataset, visible bool) error {
+	val := "hidden"
+	if visible {
+		val = "visible"
+	}
+	if err := z.SetProperty(d, "snapdir", val); err != nil {
+		return err
+	}
+	d.Snapdir = val
+	return nil
+}
+
+// dedupChecksums are the checksums dedup may use in place of the default.
+var dedupChecksums = []string{"sha256", "sha512", "skein", "edonr", "blake3"}
+
+// SetDedup sets the dedup property of the receiving dataset, which must be
+// "on", "off", "verify", or a checksum such as "sha256", optionally
+// followed by ",verify".  See DedupStats for the cost of dedup.
+func (z *ZfsH) SetDedup(d *Dataset, mode string) error {
+	valid := mode == "on" || mode == "off" || mode == "verify"
+	for _, checksum := range dedupChecksums {
+		if mode == checksum || mode == checksum+",verify" {
+			valid = true
+		}
+	}
+	if !valid {
+		return fmt.Errorf("invalid dedup value %q", mode)
+	}
+	return z.SetProperty(d, "dedup", mode)
+}
+
+// setBytes sets the size property key of the receiving dataset to size
+// bytes, 0 meaning none.
+func (z *ZfsH) setBytes(d *Dataset, key string, size uint64) error {
+	val := "none"
+	if size != 0 {
+		val = strconv.FormatUint(size, 10)
+	}
+	return z.SetProperty(d, key, val)
+}
+
+// SetQuotaBytes sets the quota of the receiving dataset to size bytes, 0
+// removing it, and updates d.Quota accordingly.
+func (z *ZfsH) SetQuotaBytes(d *Dataset, size uint64) error {
+	if err := z.setBytes(d, "quota", size); err != nil {
+		return err
+	}
+	d.Quota = strconv.FormatUint(size, 10)
+	return nil
+}
+
+// SetRefquotaBytes sets the refquota of the receiving dataset to size
+// bytes, 0 removing it.
+func (z *ZfsH) SetRefquotaBytes(d *Dataset, size uint64) error {
+	return z.setBytes(d, "refquota", size)
+}
+
+// SetReservationBytes sets the reservation of the receiving dataset to size
+// bytes, 0 removing it.
+func (z *ZfsH) SetReservationBytes(d *Dataset, size uint64) error {
+	return z.setBytes(d, "reservation", size)
+}
+
+// SetRefreservationBytes sets the refreservation of the receiving dataset to
+// size bytes, 0 removing it.
+func (z *ZfsH) SetRefreservationBytes(d *Dataset, size uint64) error {
+	return z.setBytes(d, "refreservation", size)
+}
+
+// SetVolsizeBytes resizes the receiving volume to size bytes, which must not
+// be 0, and updates d.Volsize accordingly.
+func (z *ZfsH) SetVolsizeBytes(d *Dataset, size uint64) error {
+	if size == 0 {
+		return errors.New("volsize cannot be none")
+	}
+	if err := z.setBytes(d, "volsize", size); err != nil {
+		return err
+	}
+	d.Volsize = strconv.FormatUint(size, 10)
+	return nil
+}
+
+// ResizeVolume grows the receiving volume to newSize bytes and returns it
+// refreshed.  Shrinking a volume would discard the data at its end, so
+// newSize must not be below the current volsize.
+func (z *ZfsH) ResizeVolume(d *Dataset, newSize uint64) (*Dataset, error) {
+	if d.Type != DatasetVolume {
+		return nil, fmt.Errorf("%s is not a volume", d.Name)
+	}
+	val, err := z.GetProperty(d, "volsize")
+	if err != nil {
+		return nil, err
+	}
+	current, err := strconv.ParseUint(val, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Unexpected volsize: %q", val)
+	}
+	if newSize < current {
+		return nil, fmt.Errorf("cannot shrink %s from %d to %d bytes", d.Name, current, newSize)
+	}
+	if err := z.SetVolsizeBytes(d, newSize); err != nil {
+		return nil, err
+	}
+	return z.GetDataset(d.Name)
+}
+
+// SetReadonly turns the readonly property of the receiving dataset on or off,
+// and updates d.Readonly accordingly.
+func (z *ZfsH) SetReadonly(d *Dataset, ro bool) error {
+	val := "off"
+	if ro {
+		val = "on"
+	}
+	if err := z.SetProperty(d, "readonly", val); err != nil {
+		return err
+	}
+	d.Readonly = val
+	return nil
+}
+
+// InheritProperty clears the property key of the receiving dataset, so
+// that it inherits the value of its parent, or the default value if no
+// ancestor sets it.  With recursive, the property is cleared on all
+// descendants too.
+func (z *ZfsH) InheritProperty(d *Dataset, key string, recursive bool) error {
+	args := []string{"inherit"}
+	if recursive {
+		args = append(args, "-r")
+	}
+	_, err := z.zfs(append(args, key, d.Name)...)
+	return err
+}
+
 // GetProperty returns the current value of a ZFS property from the
 // receiving dataset.
 // A full list of available ZFS properties may be found here:
 // https://www.freebsd.org/cgi/man.cgi?zfs(8).
 func (z *ZfsH) GetProperty(d *Dataset, key string) (string, error) {
-	out, err := z.zfs("get","-Hp", key, d.Name)
+	// the value is taken as is, it may contain spaces or even newlines
+	out, err := z.zfsOutput("get", "-Hp", "-o", "value", key, d.Name)
 	if err != nil {
 		return "", err
 	}
 
-	return out[0][2], nil
+	return strings.TrimSuffix(out, "\n"), nil
+}
+
+// GetPropertyRecursive returns the current value of a ZFS property for the
+// receiving dataset and all of its descendents, keyed by dataset name.
+// Values must be single line, use GetProperty for values which may not be.
+// A full list of available ZFS properties may be found here:
+// https://www.freebsd.org/cgi/man.cgi?zfs(8).
+func (z *ZfsH) GetPropertyRecursive(d *Dataset, key string) (map[string]string, error) {
+	out, err := z.zfsTabbed("get", "-Hp", "-r", "-o", "name,value", key, d.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string, len(out))
+	for _, line := range out {
+		if len(line) != 2 {
+			return nil, fmt.Errorf("Unexpected zfs get output: %q", line)
+		}
+		values[line[0]] = line[1]
+	}
+	return values, nil
+}
+
+// GetAllProperties returns all ZFS properties of the receiving dataset,
+// including user properties, keyed by property name.  Values are taken as
+// is, including spaces; the source of the values is not returned.
+func (z *ZfsH) GetAllProperties(d *Dataset) (map[string]string, error) {
+	out, err := z.zfsTabbed("get", "-Hp", "-o", "name,property,value", "all", d.Name)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := parsePropertyTree(out)
+	if err != nil {
+		return nil, err
+	}
+	props := tree[d.Name]
+	if props == nil {
+		props = map[string]string{}
+	}
+	return props, nil
+}
+
+// AllPropertiesRecursive returns all ZFS properties of the named dataset
+// and all of its descendents, including snapshots, keyed by dataset name and
+// property name, using a single zfs get command.
+func (z *ZfsH) AllPropertiesRecursive(root string) (map[string]map[string]string, error) {
+	out, err := z.zfsTabbed("get", "-Hp", "-r", "-o", "name,property,value", "all", root)
+	if err != nil {
+		return nil, err
+	}
+	return parsePropertyTree(out)
+}
+
+// SnapshotsWithProperty returns the snapshots of the receiving dataset and
+// its descendents whose property key is set to value, e.g. a user property
+// tagging snapshots for retention.  The property of all snapshots is
+// fetched at once, rather than per snapshot.
+func (z *ZfsH) SnapshotsWithProperty(d *Dataset, key, value string) ([]*Dataset, error) {
+	out, err := z.zfsTabbed("get", "-Hp", "-r", "-t", DatasetSnapshot, "-o", "name,value", key, d.Name)
+	if err != nil {
+		return nil, err
+	}
+	matching := make(map[string]bool)
+	for _, line := range out {
+		if len(line) != 2 {
+			return nil, fmt.Errorf("Unexpected zfs get output: %q", line)
+		}
+		if line[1] == value {
+			matching[line[0]] = true
+		}
+	}
+	if len(matching) == 0 {
+		return nil, nil
+	}
+
+	snapshots, err := z.listByType(DatasetSnapshot, d.Name, -1, true)
+	if err != nil {
+		return nil, err
+	}
+	var found []*Dataset
+	for _, snapshot := range snapshots {
+		if matching[snapshot.Name] {
+			found = append(found, snapshot)
+		}
+	}
+	return found, nil
+}
+
+// WatchProperty polls a ZFS property of the receiving dataset every interval
+// and sends the new value on the returned channel whenever it changes.  The
+// value at the time of the call is used as the baseline and is not sent.
+// Polling errors are ignored until the next tick; the channel is closed once
+// ctx is done.
+func (z *ZfsH) WatchProperty(ctx context.Context, d *Dataset, key string, interval time.Duration) (<-chan string, error) {
+	if interval <= 0 {
+		return nil, errors.New("watch interval must be positive")
+	}
+	last, err := z.GetProperty(d, key)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan string)
+	go func() {
+		defer close(ch)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			val, err := z.GetProperty(d, key)
+			if err != nil || val == last {
+				continue
+			}
+			last = val
+			select {
+			case ch <- val:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// PropertyDiff compares the desired ZFS properties against the current values
+// of the receiving dataset, and returns only those properties whose desired
+// value differs.  Passing the result to SetProperties applies the minimal
+// set of changes needed to reconcile the dataset.  Values are compared as
+// printed by zfs get -p, so sizes must be given in bytes, and must be single
+// line.  All values are fetched with a single zfs get; a user property which
+// is not set differs from any desired value.
+func (d *Dataset) PropertyDiff(desired map[string]string, z *ZfsH) (map[string]string, error) {
+	toSet := make(map[string]string)
+	if len(desired) == 0 {
+		return toSet, nil
+	}
+	keys := make([]string, 0, len(desired))
+	for key := range desired {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	out, err := z.zfsTabbed("get", "-Hp", "-o", "property,value,source", strings.Join(keys, ","), d.Name)
+	if err != nil {
+		return nil, err
+	}
+	current, err := parsePropertyValues(out)
+	if err != nil {
+		return nil, err
+	}
+	for key, want := range desired {
+		if got, ok := current[key]; !ok || got != want {
+			toSet[key] = want
+		}
+	}
+	return toSet, nil
 }
 
 // Rename renames a dataset.
+// With recursiveRenameSnapshots the receiving dataset must be a snapshot, and
+// name must be the short form "@newname"; the snapshots of the same name of
+// all descendent filesystems are renamed along with it.
 func (z *ZfsH) Rename( d *Dataset, name string, createParent bool, recursiveRenameSnapshots bool) (*Dataset, error) {
-	args := make([]string, 3, 5)
+	newName := name
+	if recursiveRenameSnapshots {
+		if d.Type != DatasetSnapshot {
+			return d, errors.New("can only rename snapshots recursively")
+		}
+		if !strings.HasPrefix(name, "@") || strings.ContainsAny(name[1:], "@/#") || len(name) == 1 {
+			return d, fmt.Errorf("recursive snapshot rename requires a name of the form @newname, got %q", name)
+		}
+		newName = strings.SplitN(d.Name, "@", 2)[0] + name
+	}
+
+	args := make([]string, 1, 5)
 	args[0] = "rename"
-	args[1] = d.Name
-	args[2] = name
 	if createParent {
 		args = append(args, "-p")
 	}
 	if recursiveRenameSnapshots {
 		args = append(args, "-r")
 	}
+	args = append(args, d.Name, name)
 	_, err := z.zfs(args...)
 	if err != nil {
 		return d, err
 	}
 
-	return z.GetDataset(name)
+	return z.GetDataset(newName)
+}
+
+// SwapDatasets swaps the names of two filesystems or volumes, e.g. to put a
+// populated clone in place of the dataset it replaces.  This takes three
+// renames through a temporary name (a to tmp, b to a, tmp to b), which are
+// undone if one fails.  The swap is not atomic: filesystems are unmounted
+// and mounted again at their new mountpoint by each rename, so their
+// contents are briefly unavailable, and other processes may observe the
+// temporary name.  On success the names of a and b are swapped too.
+func (z *ZfsH) SwapDatasets(a, b *Dataset) error {
+	for _, d := range []*Dataset{a, b} {
+		if d.Type != DatasetFilesystem && d.Type != DatasetVolume {
+			return fmt.Errorf("can only swap filesystems and volumes, %s is a %s", d.Name, d.Type)
+		}
+	}
+	tmp := a.Name + "-swap"
+	if _, err := z.GetDataset(tmp); err == nil {
+		return fmt.Errorf("temporary dataset %s already exists", tmp)
+	}
+
+	if _, err := z.zfs("rename", a.Name, tmp); err != nil {
+		return err
+	}
+	if _, err := z.zfs("rename", b.Name, a.Name); err != nil {
+		if _, rerr := z.zfs("rename", tmp, a.Name); rerr != nil {
+			return fmt.Errorf("%v; rolling back failed, %s was left as %s: %v", err, a.Name, tmp, rerr)
+		}
+		return err
+	}
+	if _, err := z.zfs("rename", tmp, b.Name); err != nil {
+		if _, rerr := z.zfs("rename", a.Name, b.Name); rerr != nil {
+			return fmt.Errorf("%v; rolling back failed, %s was left as %s and %s as %s: %v", err, b.Name, a.Name, a.Name, tmp, rerr)
+		}
+		if _, rerr := z.zfs("rename", tmp, a.Name); rerr != nil {
+			return fmt.Errorf("%v; rolling back failed, %s was left as %s: %v", err, a.Name, tmp, rerr)
+		}
+		return err
+	}
+	a.Name, b.Name = b.Name, a.Name
+	return nil
 }
 
 // Snapshots returns a slice of all ZFS snapshots of a given dataset.
@@ -520,11 +1906,69 @@ func (z *ZfsH) Bookmarks(d *Dataset, depth int) ([]*Dataset, error) {
 	return z.BookmarksByName(d.Name, depth)
 }
 
+// Redact creates the redaction bookmark bookmarkName of the receiving
+// snapshot, from which a redacted send omits the blocks modified in
+// redactSnaps.  Each redaction snapshot must be a snapshot of a clone of
+// snap, directly or through further clones.  The pool must support the
+// redaction_bookmarks feature, otherwise ErrFeatureUnsupported is returned.
+func (z *ZfsH) Redact(snap *Dataset, bookmarkName string, redactSnaps []string) (*Dataset, error) {
+	if snap.Type != DatasetSnapshot {
+		return nil, fmt.Errorf("%s is not a snapshot", snap.Name)
+	}
+	if bookmarkName == "" || strings.ContainsAny(bookmarkName, "@#/") {
+		return nil, fmt.Errorf("invalid bookmark name %q", bookmarkName)
+	}
+	if len(redactSnaps) == 0 {
+		return nil, errors.New("at least one redaction snapshot is required")
+	}
+	for _, name := range redactSnaps {
+		if !strings.Contains(name, "@") {
+			return nil, fmt.Errorf("redaction snapshot %s is not a snapshot", name)
+		}
+		clone, err := z.GetDataset(parentName(name))
+		if err != nil {
+			return nil, err
+		}
+		origins, err := z.Origins(clone)
+		if err != nil {
+			return nil, err
+		}
+		cloned := false
+		for _, origin := range origins {
+			cloned = cloned || origin == snap.Name
+		}
+		if !cloned {
+			return nil, fmt.Errorf("redaction snapshot %s is not of a clone of %s", name, snap.Name)
+		}
+	}
+
+	zp := &Zpool{Name: poolName(snap.Name)}
+	supported, err := z.PoolSupportsFeature(zp, "redaction_bookmarks")
+	if err != nil {
+		return nil, err
+	}
+	if !supported {
+		return nil, fmt.Errorf("%w: redaction_bookmarks is not enabled on %s", ErrFeatureUnsupported, zp.Name)
+	}
+
+	args := append([]string{"redact", snap.Name, bookmarkName}, redactSnaps...)
+	if _, err := z.zfs(args...); err != nil {
+		return nil, err
+	}
+	return z.GetDataset(parentName(snap.Name) + "#" + bookmarkName)
+}
+
 // CreateFilesystem creates a new ZFS filesystem with the specified name and
 // properties.
+// A recordsize or volblocksize is validated before creating the dataset,
+// and verified on the created dataset.
 // A full list of available ZFS properties may be found here:
 // https://www.freebsd.org/cgi/man.cgi?zfs(8).
 func (z *ZfsH) CreateFilesystem(name string, properties map[string]string) (*Dataset, error) {
+	blockSizes, err := checkBlockSizes(properties)
+	if err != nil {
+		return nil, err
+	}
 	args := make([]string, 1, 4)
 	args[0] = "create"
 
@@ -533,11 +1977,31 @@ func (z *ZfsH) CreateFilesystem(name string, properties map[string]string) (*Dat
 	}
 
 	args = append(args, name)
-	_, err := z.zfs(args...)
+	_, err = z.zfs(args...)
 	if err != nil {
 		return nil, err
 	}
-	return z.GetDataset(name)
+	return z.getCreated(name, blockSizes)
+}
+
+// CreateFilesystemWithSnapshot creates a new ZFS filesystem like
+// CreateFilesystem and takes an initial snapshot of it with the specified
+// name, e.g. as the base for later clones.  If the snapshot cannot be
+// taken, the new filesystem is destroyed again, so that no half-provisioned
+// filesystem is left behind; use CreateFilesystem and Snapshot to keep it.
+func (z *ZfsH) CreateFilesystemWithSnapshot(name, snapName string, properties map[string]string) (fs *Dataset, snap *Dataset, err error) {
+	fs, err = z.CreateFilesystem(name, properties)
+	if err != nil {
+		return nil, nil, err
+	}
+	snap, err = z.Snapshot(fs, snapName, false)
+	if err != nil {
+		if destroyErr := z.Destroy(fs, DestroyDefault); destroyErr != nil {
+			return nil, nil, fmt.Errorf("%v; cannot destroy %s again: %v", err, name, destroyErr)
+		}
+		return nil, nil, err
+	}
+	return fs, snap, nil
 }
 
 // Snapshot creates a new ZFS snapshot of the receiving dataset, using the
@@ -558,23 +2022,240 @@ func (z *ZfsH) Snapshot(d *Dataset, name string, recursive bool) (*Dataset, erro
 	return z.GetDataset(snapName)
 }
 
-// Snapshot creates a new ZFS snapshot of the receiving dataset, using the
-// specified name.  Optionally, the snapshot can be taken recursively, creating
-// snapshots of all descendent filesystems in a single, atomic operation.
-func (z *ZfsH) Bookmark(d *Dataset, name string, recursive bool) (*Dataset, error) {
-	args := make([]string, 1, 4)
-	args[0] = "bookmark"
+// Hold places the hold tag on the receiving snapshot, which prevents it
+// from being destroyed until the hold is released.  With recursive, the
+// snapshots of the same name of all descendent filesystems are held too.
+func (z *ZfsH) Hold(d *Dataset, tag string, recursive bool) error {
+	if d.Type != DatasetSnapshot {
+		return errors.New("can only hold snapshots")
+	}
+	args := []string{"hold"}
 	if recursive {
 		args = append(args, "-r")
 	}
-	snapName := fmt.Sprintf("%s@%s", d.Name, name)
-	bookMarkName := fmt.Sprintf("%s#%s", d.Name, name)
-	args = append(args, snapName, bookMarkName)
-	_, err := z.zfs(args...)
+	_, err := z.zfs(append(args, tag, d.Name)...)
+	return err
+}
+
+// Release removes the hold tag from the receiving snapshot, and with
+// recursive from the snapshots of the same name of all descendent
+// filesystems.
+func (z *ZfsH) Release(d *Dataset, tag string, recursive bool) error {
+	if d.Type != DatasetSnapshot {
+		return errors.New("can only release snapshots")
+	}
+	args := []string{"release"}
+	if recursive {
+		args = append(args, "-r")
+	}
+	_, err := z.zfs(append(args, tag, d.Name)...)
+	return err
+}
+
+// Holds returns the hold tags of the receiving snapshot.
+func (z *ZfsH) Holds(d *Dataset) ([]string, error) {
+	if d.Type != DatasetSnapshot {
+		return nil, errors.New("only snapshots have holds")
+	}
+	out, err := z.zfsTabbed("holds", "-H", d.Name)
 	if err != nil {
 		return nil, err
 	}
-	return z.GetDataset(snapName)
+	holds, err := parseHolds(out)
+	if err != nil {
+		return nil, err
+	}
+	return holds[d.Name], nil
+}
+
+// HoldsRecursive returns the hold tags of the snapshots of the receiving
+// filesystem or volume and all its descendants, keyed by snapshot name,
+// e.g. to release recursive holds reliably.  For a snapshot, the snapshots
+// of the same name of all descendent filesystems are considered.  Snapshots
+// without holds are left out.  zfs holds only takes snapshots, so for a
+// filesystem or volume they are listed first, and passed to zfs holds in
+// batches.
+func (z *ZfsH) HoldsRecursive(d *Dataset) (map[string][]string, error) {
+	if d.Type == DatasetSnapshot {
+		out, err := z.zfsTabbed("holds", "-H", "-r", d.Name)
+		if err != nil {
+			return nil, err
+		}
+		return parseHolds(out)
+	}
+
+	out, err := z.zfs("list", "-H", "-r", "-t", DatasetSnapshot, "-o", "name", d.Name)
+	if err != nil {
+		return nil, err
+	}
+	holds := make(map[string][]string)
+	for start := 0; start < len(out); start += holdsBatchSize {
+		end := start + holdsBatchSize
+		if end > len(out) {
+			end = len(out)
+		}
+		args := []string{"holds", "-H"}
+		for _, line := range out[start:end] {
+			args = append(args, line[0])
+		}
+		batch, err := z.zfsTabbed(args...)
+		if err != nil {
+			return nil, err
+		}
+		found, err := parseHolds(batch)
+		if err != nil {
+			return nil, err
+		}
+		for name, tags := range found {
+			holds[name] = tags
+		}
+	}
+	return holds, nil
+}
+
+// holdsBatchSize is the number of snapshots passed to a single zfs holds,
+// keeping its command line short on large trees.
+const holdsBatchSize = 256
+
+// Bookmark creates a new ZFS bookmark with the specified name and returns it.
+// The source depends on the type of the receiving dataset:
+//  - a filesystem or volume bookmarks its snapshot of the same name,
+//  - a snapshot is bookmarked directly,
+//  - a bookmark is copied, which requires a zfs version supporting it.
+// zfs bookmark cannot operate recursively, so recursive must be false.
+func (z *ZfsH) Bookmark(d *Dataset, name string, recursive bool) (*Dataset, error) {
+	if recursive {
+		return nil, errors.New("bookmarks cannot be created recursively")
+	}
+	fsName := strings.SplitN(strings.SplitN(d.Name, "@", 2)[0], "#", 2)[0]
+	source := d.Name
+	switch d.Type {
+	case DatasetSnapshot:
+	case DatasetBookmark:
+		if !z.bookmarkCopySupported() {
+			return nil, ErrFeatureUnsupported
+		}
+	default:
+		source = fmt.Sprintf("%s@%s", d.Name, name)
+	}
+	bookMarkName := fmt.Sprintf("%s#%s", fsName, name)
+	_, err := z.zfs("bookmark", source, bookMarkName)
+	if err != nil {
+		return nil, err
+	}
+	return z.GetDataset(bookMarkName)
+}
+
+// bookmarkCopySupported reports whether zfs bookmark accepts a bookmark as
+// source, according to its usage.
+func (z *ZfsH) bookmarkCopySupported() bool {
+	_, err := z.zfs("bookmark")
+	zerr, ok := err.(*Error)
+	return ok && strings.Contains(zerr.Stderr, "<snapshot|bookmark>")
+}
+
+// snapshotUniqueLimit is the number of suffixed names SnapshotUnique tries
+// before giving up.
+const snapshotUniqueLimit = 100
+
+// SnapshotUnique creates a new ZFS snapshot like Snapshot.  If a snapshot of
+// that name already exists, the name is suffixed with -1, -2, ... until an
+// unused name is found.
+func (z *ZfsH) SnapshotUnique(d *Dataset, baseName string, recursive bool) (*Dataset, error) {
+	name := baseName
+	for i := 1; ; i++ {
+		snap, err := z.Snapshot(d, name, recursive)
+		if i > snapshotUniqueLimit || !stderrContains(err, "already exists") {
+			return snap, err
+		}
+		name = fmt.Sprintf("%s-%d", baseName, i)
+	}
+}
+
+// EnsureSnapshot creates a snapshot like Snapshot, but returns the existing
+// snapshot instead of failing if it already exists, so that it may be called
+// repeatedly.  When recursive, zfs creates no snapshot at all if any
+// descendent already has one of that name; only the top one is returned.
+func (z *ZfsH) EnsureSnapshot(d *Dataset, name string, recursive bool) (*Dataset, error) {
+	snap, err := z.Snapshot(d, name, recursive)
+	if stderrContains(err, "already exists") {
+		return z.GetDataset(fmt.Sprintf("%s@%s", d.Name, name))
+	}
+	return snap, err
+}
+
+// SnapshotRecursiveExcept creates snapshots with the specified name of the
+// receiving dataset and all of its descendent filesystems and volumes, except
+// those listed in exclude.  An excluded name also excludes everything below
+// it.  The remaining snapshots are created by a single zfs command, so they
+// are atomic across the set.
+func (z *ZfsH) SnapshotRecursiveExcept(d *Dataset, name string, exclude []string) ([]*Dataset, error) {
+	descendents, err := z.listByType("filesystem,volume", d.Name, -1, true)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{"snapshot"}
+	created := make(map[string]bool)
+	for _, ds := range descendents {
+		if isExcluded(ds.Name, exclude) {
+			continue
+		}
+		snapName := fmt.Sprintf("%s@%s", ds.Name, name)
+		args = append(args, snapName)
+		created[snapName] = true
+	}
+	if len(created) == 0 {
+		return nil, errors.New("all datasets are excluded")
+	}
+	if _, err = z.zfs(args...); err != nil {
+		return nil, err
+	}
+
+	snapshots, err := z.listByType(DatasetSnapshot, d.Name, -1, true)
+	if err != nil {
+		return nil, err
+	}
+	var result []*Dataset
+	for _, snap := range snapshots {
+		if created[snap.Name] {
+			result = append(result, snap)
+		}
+	}
+	return result, nil
+}
+
+// SnapshotBulk creates a snapshot with the specified name of each of the
+// named datasets, running at most concurrency zfs commands at a time.  The
+// returned map holds the result for every dataset, nil on success.  An error
+// is only returned for invalid arguments.
+func (z *ZfsH) SnapshotBulk(names []string, snapName string, concurrency int) (map[string]error, error) {
+	if concurrency < 1 {
+		return nil, errors.New("concurrency must be at least 1")
+	}
+
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		results = make(map[string]error, len(names))
+		sem     = make(chan struct{}, concurrency)
+	)
+	for _, name := range names {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(name string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			_, err := z.zfs("snapshot", fmt.Sprintf("%s@%s", name, snapName))
+			mu.Lock()
+			results[name] = err
+			mu.Unlock()
+		}(name)
+	}
+	wg.Wait()
+	return results, nil
 }
 
 // Rollback rolls back the receiving ZFS dataset to a previous snapshot.
@@ -598,9 +2279,39 @@ func (z *ZfsH) Rollback(d *Dataset, destroyMoreRecent bool) error {
 	return err
 }
 
+// TopConsumers returns the n filesystems and volumes using the most space,
+// largest first, as sorted by zfs itself on the used property.  A
+// non-positive n returns all of them.
+func (z *ZfsH) TopConsumers(n int) ([]*Dataset, error) {
+	args := []string{"list", "-Hp", "-t", "filesystem,volume", "-o", strings.Join(DsPropList, ","), "-S", "used"}
+	out, err := z.zfs(args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var datasets []*Dataset
+	name := ""
+	var ds *Dataset
+	for _, line := range out {
+		if name != line[0] {
+			if n > 0 && len(datasets) == n {
+				break
+			}
+			name = line[0]
+			ds = &Dataset{Name: name}
+			datasets = append(datasets, ds)
+		}
+		if err := ds.parseLine(line); err != nil {
+			return nil, err
+		}
+	}
+	return datasets, nil
+}
+
 // Children returns a slice of children of the receiving ZFS dataset.
 // A recursion depth may be specified, or a depth of 0 allows unlimited
-// recursion.
+// recursion.  If the dataset does not exist, e.g. because it was destroyed
+// in the meantime, the returned error wraps ErrDatasetNotFound.
 func (z *ZfsH) Children(d *Dataset, depth uint64) ([]*Dataset, error) {
 	args := []string{"list"}
 	if depth > 0 {
@@ -614,7 +2325,7 @@ func (z *ZfsH) Children(d *Dataset, depth uint64) ([]*Dataset, error) {
 
 	out, err := z.zfs(args...)
 	if err != nil {
-		return nil, err
+		return nil, classifyError(err, ErrDatasetNotFound, "dataset does not exist")
 	}
 
 	var datasets []*Dataset
@@ -630,6 +2341,10 @@ func (z *ZfsH) Children(d *Dataset, depth uint64) ([]*Dataset, error) {
 			return nil, err
 		}
 	}
+	if len(datasets) == 0 {
+		// not even the dataset itself was listed
+		return nil, fmt.Errorf("%s: %w", d.Name, ErrDatasetNotFound)
+	}
 	return datasets[1:], nil
 }
 
@@ -648,3 +2363,103 @@ func (z *ZfsH) Diff(d *Dataset, snapshot string) ([]*InodeChange, error) {
 	}
 	return inodeChanges, nil
 }
+
+// DiffWithInodes returns the changes like Diff, with the object number of
+// every changed file in Inode.  zfs diff does not report object numbers, so
+// they are looked up with ls -di on the live filesystem, or in the
+// .zfs/snapshot directory of the snapshot for removed files, which requires
+// both to be mounted.  As the lookup follows the diff, files that vanish in
+// the meantime are left with Inode 0, and files replaced in the meantime
+// report the object number of their replacement.
+func (z *ZfsH) DiffWithInodes(d *Dataset, snapshot string) ([]*InodeChange, error) {
+	inodeChanges, err := z.Diff(d, snapshot)
+	if err != nil {
+		return nil, err
+	}
+	if len(inodeChanges) == 0 {
+		return inodeChanges, nil
+	}
+	snapshotRoot := ""
+	paths := make([]string, len(inodeChanges))
+	for i, change := range inodeChanges {
+		switch change.Change {
+		case Removed:
+			if snapshotRoot == "" {
+				snapshotRoot, err = z.SnapshotPath(&Dataset{Name: snapshot, Type: DatasetSnapshot})
+				if err != nil {
+					return nil, err
+				}
+			}
+			paths[i] = snapshotRoot + strings.TrimPrefix(change.Path, strings.TrimSuffix(d.Mountpoint, "/"))
+		case Renamed:
+			paths[i] = change.NewPath
+		default:
+			paths[i] = change.Path
+		}
+	}
+
+	inodes := make(map[string]uint64, len(paths))
+	for start := 0; start < len(paths); start += inodeBatchSize {
+		end := start + inodeBatchSize
+		if end > len(paths) {
+			end = len(paths)
+		}
+		if err := z.lookupInodes(paths[start:end], inodes); err != nil {
+			return nil, err
+		}
+	}
+	for i, change := range inodeChanges {
+		change.Inode = inodes[paths[i]]
+	}
+	return inodeChanges, nil
+}
+
+// inodeBatchSize is the number of paths looked up by a single ls, keeping
+// its command line short.
+const inodeBatchSize = 256
+
+// lookupInodes adds the inode numbers of paths to inodes, leaving out the
+// paths which do not exist.  ls is run directly rather than through a
+// script, so that no shell is run with sudo.
+func (z *ZfsH) lookupInodes(paths []string, inodes map[string]uint64) error {
+	var stdout bytes.Buffer
+	c := command{
+		Command: z.wrap("ls"),
+		Stdout: &stdout,
+		zh: z,
+	}
+	// ls fails if any path is missing, but still lists the others
+	_, err := c.Run(inodeArgs(paths, !z.Local)...)
+	if err != nil && !stderrContains(err, "No such file or directory") {
+		return err
+	}
+	found, err := parseInodeList(stdout.String())
+	if err != nil {
+		return err
+	}
+	for p, inode := range found {
+		inodes[p] = inode
+	}
+	return nil
+}
+
+// DiffUnder returns changes between a snapshot and the given ZFS dataset like
+// Diff, limited to paths at or below prefix.  Renames are included if either
+// the old or the new path is below prefix.
+func (z *ZfsH) DiffUnder(d *Dataset, snapshot, prefix string) ([]*InodeChange, error) {
+	inodeChanges, err := z.Diff(d, snapshot)
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "/" {
+		prefix = strings.TrimSuffix(prefix, "/")
+	}
+	var filtered []*InodeChange
+	for _, change := range inodeChanges {
+		if isUnderPath(change.Path, prefix) ||
+			(change.NewPath != "" && isUnderPath(change.NewPath, prefix)) {
+			filtered = append(filtered, change)
+		}
+	}
+	return filtered, nil
+}
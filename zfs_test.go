@@ -1,13 +1,19 @@
 package zfs_test
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math"
+	"net"
 	"os"
 	"path/filepath"
 	"reflect"
 	"runtime"
+	"strings"
 	"testing"
 	"time"
 	zfs "github.com/edillmann/go-zfs"
@@ -92,12 +98,162 @@ func TestDatasets1(t *testing.T) {
 }
 */
 
+func TestCheckpoint(t *testing.T) {
+	zh := getSSHTestHandle()
+	zpoolTest(zh, t, func() {
+		zp, err := zh.GetZpool("test")
+		ok(t, err)
+		_, exists, err := zh.CheckpointSpace(zp)
+		ok(t, err)
+		assert(t, !exists, "pool should have no checkpoint")
+
+		ok(t, zh.Checkpoint(zp))
+		_, exists, err = zh.CheckpointSpace(zp)
+		ok(t, err)
+		assert(t, exists, "pool should have a checkpoint")
+
+		_, err = zh.CreateFilesystem("test/after-checkpoint", nil)
+		ok(t, err)
+		ok(t, zh.ExportZpool(zp))
+		zp, err = zh.ImportZpool("test", zfs.ZpoolImportOptions{Dirs: []string{"/tmp"}, RewindToCheckpoint: true})
+		ok(t, err)
+		_, err = zh.GetDataset("test/after-checkpoint")
+		assert(t, err != nil, "filesystem should be rewound away")
+
+		ok(t, zh.Checkpoint(zp))
+		ok(t, zh.DiscardCheckpoint(zp))
+	})
+}
+
+func TestInventory(t *testing.T) {
+	zh := getSSHTestHandle()
+	zpoolTest(zh, t, func() {
+		f, err := zh.CreateFilesystem("test/inventory-fs", nil)
+		ok(t, err)
+		s, err := zh.Snapshot(f, "one", false)
+		ok(t, err)
+		_, err = zh.CreateVolume("test/inventory-volume", uint64(pow2(23)), nil)
+		ok(t, err)
+
+		inventory, err := zh.Inventory()
+		ok(t, err)
+		var pool *zfs.PoolInventory
+		for _, p := range inventory.Pools {
+			if p.Pool.Name == "test" {
+				pool = p
+			}
+		}
+		assert(t, pool != nil, "test pool should be in the inventory")
+		equals(t, 2, len(pool.Filesystems))
+		equals(t, 1, len(pool.Volumes))
+		equals(t, 1, len(pool.Snapshots))
+		equals(t, s.Name, pool.Snapshots[0].Name)
+		equals(t, 0, len(pool.Bookmarks))
+	})
+}
+
+func TestPoolSupportsFeature(t *testing.T) {
+	zh := getSSHTestHandle()
+	zpoolTest(zh, t, func() {
+		zp, err := zh.GetZpool("test")
+		ok(t, err)
+		supported, err := zh.PoolSupportsFeature(zp, "feature@async_destroy")
+		ok(t, err)
+		assert(t, supported, "async_destroy should be enabled on a new pool")
+		supported, err = zh.PoolSupportsFeature(zp, "no_such_feature")
+		ok(t, err)
+		assert(t, !supported, "unknown features should not be supported")
+
+		dst, err := zh.CreateFilesystem("test/features-dst", nil)
+		ok(t, err)
+		f, err := zh.CreateFilesystem("test/features-src", nil)
+		ok(t, err)
+		s, err := zh.Snapshot(f, "one", false)
+		ok(t, err)
+		opts := zfs.ReplicateOptions{RequiredFeatures: []string{"no_such_feature"}}
+		err = zh.ReplicateTo(zh, s.Name, "", dst.Name+"/copy", opts)
+		assert(t, errors.Is(err, zfs.ErrFeatureUnsupported), "missing feature should be reported")
+	})
+}
+
+func TestDatasetsChan(t *testing.T) {
+	zh := getSSHTestHandle()
+	zpoolTest(zh, t, func() {
+		_, err := zh.CreateFilesystem("test/chan-a", nil)
+		ok(t, err)
+		_, err = zh.CreateFilesystem("test/chan-b", nil)
+		ok(t, err)
+
+		datasets, errs := zh.DatasetsChan(context.Background(), zfs.DatasetFilesystem, "test", -1)
+		var names []string
+		for ds := range datasets {
+			names = append(names, ds.Name)
+		}
+		ok(t, <-errs)
+		equals(t, []string{"test", "test/chan-a", "test/chan-b"}, names)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		datasets, errs = zh.DatasetsChan(ctx, "", "test", -1)
+		<-datasets
+		cancel()
+		for range datasets {
+		}
+		equals(t, context.Canceled, <-errs)
+	})
+}
+
+func TestUnhealthyStatus(t *testing.T) {
+	zh := getSSHTestHandle()
+	zpoolTest(zh, t, func() {
+		summary, healthy, err := zh.UnhealthyStatus()
+		ok(t, err)
+		assert(t, healthy, "pools should be healthy: "+summary)
+	})
+}
+
+func TestWalk(t *testing.T) {
+	zh := getSSHTestHandle()
+	zpoolTest(zh, t, func() {
+		for _, name := range []string{"test/walk", "test/walk/a", "test/walk/a/deep", "test/walk/b"} {
+			_, err := zh.CreateFilesystem(name, nil)
+			ok(t, err)
+		}
+
+		var visited []string
+		err := zh.Walk("test/walk", func(d *zfs.Dataset) error {
+			visited = append(visited, d.Name)
+			if d.Name == "test/walk/a" {
+				return zfs.SkipTree
+			}
+			return nil
+		})
+		ok(t, err)
+		equals(t, []string{"test/walk", "test/walk/a", "test/walk/b"}, visited)
+
+		stop := errors.New("stop")
+		visited = nil
+		err = zh.Walk("test/walk", func(d *zfs.Dataset) error {
+			visited = append(visited, d.Name)
+			return stop
+		})
+		equals(t, stop, err)
+		equals(t, []string{"test/walk"}, visited)
+	})
+}
+
 func TestDatasets(t *testing.T) {
 	zh := getSSHTestHandle()
 	zpoolTest(zh, t, func() {
 
-		_, err := zh.Datasets("",99)
+		_, err := zh.Datasets("", "", 99, false)
+		ok(t, err)
+
+		_, err = zh.CreateVolume("test/types-volume", uint64(pow2(23)), nil)
+		ok(t, err)
+		datasets, err := zh.DatasetsOfTypes("test", -1, true, zfs.DatasetFilesystem, zfs.DatasetVolume)
 		ok(t, err)
+		equals(t, 2, len(datasets))
+		equals(t, zfs.DatasetVolume, datasets[1].Type)
 
 		ds, err := zh.GetDataset("test")
 		ok(t, err)
@@ -164,158 +320,1211 @@ func TestCreateFilesystemWithProperties(t *testing.T) {
 	})
 }
 
-func TestVolumes(t *testing.T) {
+func TestCreateFilesystemWithRecordsize(t *testing.T) {
 	zh := getSSHTestHandle()
 	zpoolTest(zh, t, func() {
+		_, err := zh.CreateFilesystem("test/recordsize-test", map[string]string{"recordsize": "96K"})
+		assert(t, err != nil, "invalid recordsize should be rejected")
 
-		v, err := zh.CreateVolume("test/volume-test", uint64(pow2(23)), nil)
+		f, err := zh.CreateFilesystem("test/recordsize-test", map[string]string{"recordsize": "16K"})
 		ok(t, err)
+		recordsize, err := zh.GetProperty(f, "recordsize")
+		ok(t, err)
+		equals(t, "16384", recordsize)
 
-		// volumes are sometimes "busy" if you try to manipulate them right away
-		sleep(1)
+		ok(t, zh.Destroy(f, zfs.DestroyDefault))
+	})
+}
 
-		equals(t, zfs.DatasetVolume, v.Type)
-		volumes, err := zh.Volumes("", 99)
+func TestCreateFilesystemWithSnapshot(t *testing.T) {
+	zh := getSSHTestHandle()
+	zpoolTest(zh, t, func() {
+		f, s, err := zh.CreateFilesystemWithSnapshot("test/base-test", "base", nil)
 		ok(t, err)
+		equals(t, "test/base-test", f.Name)
+		equals(t, "test/base-test@base", s.Name)
 
-		for _, volume := range volumes {
-			equals(t, zfs.DatasetVolume, volume.Type)
-		}
+		_, _, err = zh.CreateFilesystemWithSnapshot("test/invalid-test", "in@valid", nil)
+		assert(t, err != nil, "invalid snapshot name should fail")
+		_, err = zh.GetDataset("test/invalid-test")
+		assert(t, err != nil, "filesystem should have been destroyed again")
 
-		ok(t, zh.Destroy(v, zfs.DestroyDefault))
+		ok(t, zh.Destroy(f, zfs.DestroyRecursive))
 	})
 }
-func TestSnapshot(t *testing.T) {
+
+func TestSetReadonly(t *testing.T) {
 	zh := getSSHTestHandle()
 	zpoolTest(zh, t, func() {
+		f, err := zh.CreateFilesystem("test/readonly-test", nil)
+		ok(t, err)
+		assert(t, !f.IsReadonly(), "new filesystem should not be readonly")
 
-		f, err := zh.CreateFilesystem("test/snapshot-test", nil)
+		ok(t, zh.SetReadonly(f, true))
+		assert(t, f.IsReadonly(), "SetReadonly should update the dataset")
+		f, err = zh.GetDataset(f.Name)
 		ok(t, err)
+		assert(t, f.IsReadonly(), "filesystem should be readonly")
 
-		filesystems, err := zh.Filesystems("", 99)
+		ok(t, zh.SetReadonly(f, false))
+		f, err = zh.GetDataset(f.Name)
 		ok(t, err)
+		assert(t, !f.IsReadonly(), "filesystem should not be readonly")
 
-		for _, filesystem := range filesystems {
-			equals(t, zfs.DatasetFilesystem, filesystem.Type)
-		}
+		ok(t, zh.Destroy(f, zfs.DestroyDefault))
+	})
+}
 
-		s, err := zh.Snapshot(f, "test", false)
+func TestInheritProperty(t *testing.T) {
+	zh := getSSHTestHandle()
+	zpoolTest(zh, t, func() {
+		parent, err := zh.CreateFilesystem("test/inherit-test", nil)
+		ok(t, err)
+		child, err := zh.CreateFilesystem("test/inherit-test/child", map[string]string{"compression": "gzip"})
+		ok(t, err)
+		_, err = zh.CreateFilesystem("test/inherit-test/child/grandchild", map[string]string{"compression": "gzip"})
 		ok(t, err)
 
-		equals(t, zfs.DatasetSnapshot, s.Type)
-
-		equals(t, "test/snapshot-test@test", s.Name)
+		ok(t, zh.InheritProperty(child, "compression", false))
+		parentValue, err := zh.GetProperty(parent, "compression")
+		ok(t, err)
+		childValue, err := zh.GetProperty(child, "compression")
+		ok(t, err)
+		equals(t, parentValue, childValue)
+		values, err := zh.GetPropertyRecursive(child, "compression")
+		ok(t, err)
+		equals(t, "gzip", values["test/inherit-test/child/grandchild"])
 
-		ok(t, zh.Destroy(s, zfs.DestroyDefault))
+		ok(t, zh.InheritProperty(child, "compression", true))
+		values, err = zh.GetPropertyRecursive(child, "compression")
+		ok(t, err)
+		equals(t, parentValue, values["test/inherit-test/child/grandchild"])
 
-		ok(t, zh.Destroy(f,zfs.DestroyDefault))
+		ok(t, zh.Destroy(parent, zfs.DestroyRecursive))
 	})
 }
 
-func TestClone(t *testing.T) {
+func TestPropertyDiff(t *testing.T) {
 	zh := getSSHTestHandle()
 	zpoolTest(zh, t, func() {
+		f, err := zh.CreateFilesystem("test/propdiff-test", map[string]string{"compression": "gzip", "user:set": "yes"})
+		ok(t, err)
 
-		f, err := zh.CreateFilesystem("test/snapshot-test", nil)
+		toSet, err := f.PropertyDiff(map[string]string{
+			"compression": "gzip",
+			"atime":       "off",
+			"user:set":    "yes",
+			"user:unset":  "-",
+		}, zh)
 		ok(t, err)
+		equals(t, map[string]string{"atime": "off", "user:unset": "-"}, toSet)
 
-		filesystems, err := zh.Filesystems("", 99)
+		ok(t, zh.Destroy(f, zfs.DestroyDefault))
+	})
+}
+
+func TestSetProperties(t *testing.T) {
+	zh := getSSHTestHandle()
+	zpoolTest(zh, t, func() {
+		f, err := zh.CreateFilesystem("test/setprops-test", nil)
 		ok(t, err)
 
-		for _, filesystem := range filesystems {
-			equals(t, zfs.DatasetFilesystem, filesystem.Type)
-		}
+		ok(t, zh.SetProperties(f, map[string]string{
+			"compression": "gzip",
+			"atime":       "off",
+			"user:note":   "a=b",
+		}))
+		values, err := zh.GetAllProperties(f)
+		ok(t, err)
+		equals(t, "gzip", values["compression"])
+		equals(t, "off", values["atime"])
+		equals(t, "a=b", values["user:note"])
 
-		s, err := zh.Snapshot(f, "test", false)
+		assert(t, zh.SetProperties(f, map[string]string{"a=b": "c"}) != nil, "expected an error for an invalid property name")
+
+		ok(t, zh.Destroy(f, zfs.DestroyDefault))
+	})
+}
+
+func TestGetAllProperties(t *testing.T) {
+	zh := getSSHTestHandle()
+	zpoolTest(zh, t, func() {
+		f, err := zh.CreateFilesystem("test/allprops-test", map[string]string{"org.test:note": "two words"})
 		ok(t, err)
 
-		equals(t, zfs.DatasetSnapshot, s.Type)
-		equals(t, "test/snapshot-test@test", s.Name)
+		props, err := zh.GetAllProperties(f)
+		ok(t, err)
+		equals(t, "filesystem", props["type"])
+		equals(t, "two words", props["org.test:note"])
+		_, hasSource := props["source"]
+		assert(t, !hasSource, "the source column should not be returned")
 
-		c, err := zh.Clone(s, "test/clone-test", nil)
+		ok(t, zh.Destroy(f, zfs.DestroyDefault))
+	})
+}
+
+func TestSetMountpointLegacy(t *testing.T) {
+	zh := getSSHTestHandle()
+	zpoolTest(zh, t, func() {
+		f, err := zh.CreateFilesystem("test/legacy-test", nil)
 		ok(t, err)
 
-		equals(t, zfs.DatasetFilesystem, c.Type)
+		ok(t, zh.SetMountpoint(f, "legacy"))
+		equals(t, "legacy", f.Mountpoint)
 
-		ok(t, zh.Destroy(c, zfs.DestroyDefault))
+		_, err = zh.Mount(f, false, nil)
+		assert(t, errors.Is(err, zfs.ErrLegacyMountpoint), "Mount should refuse legacy mountpoints")
 
-		ok(t, zh.Destroy(s, zfs.DestroyDefault))
+		assert(t, zh.SetMountpoint(f, "relative") != nil, "relative mountpoint should be rejected")
 
 		ok(t, zh.Destroy(f, zfs.DestroyDefault))
 	})
 }
 
-func TestSendSnapshot(t *testing.T) {
+func TestSetCanmount(t *testing.T) {
 	zh := getSSHTestHandle()
 	zpoolTest(zh, t, func() {
-		f, err := zh.CreateFilesystem("test/snapshot-test", nil)
+		f, err := zh.CreateFilesystem("test/canmount-test", map[string]string{"canmount": "noauto"})
 		ok(t, err)
+		equals(t, "noauto", f.Canmount)
 
-		filesystems, err := zh.Filesystems("", 99)
+		ok(t, zh.SetCanmount(f, "off"))
+		f, err = zh.GetDataset(f.Name)
 		ok(t, err)
+		equals(t, "off", f.Canmount)
 
-		for _, filesystem := range filesystems {
-			equals(t, zfs.DatasetFilesystem, filesystem.Type)
-		}
+		assert(t, zh.SetCanmount(f, "yes") != nil, "invalid canmount value should be rejected")
 
-		s, err := zh.Snapshot(f, "test", false)
+		ok(t, zh.Destroy(f, zfs.DestroyDefault))
+	})
+}
+
+func TestSetSizeBytes(t *testing.T) {
+	zh := getSSHTestHandle()
+	zpoolTest(zh, t, func() {
+		f, err := zh.CreateFilesystem("test/size-test", nil)
 		ok(t, err)
 
-		file, _ := ioutil.TempFile("/tmp/", "zfs-")
-		defer file.Close()
-		err = file.Truncate(pow2(30))
+		ok(t, zh.SetQuotaBytes(f, uint64(pow2(30))))
+		quota, err := zh.GetProperty(f, "quota")
 		ok(t, err)
-		defer os.Remove(file.Name())
+		equals(t, strconv.FormatInt(pow2(30), 10), quota)
 
-		err = zh.SendSnapshot(s.Name, "", file, zfs.SendDefault, "")
+		ok(t, zh.SetQuotaBytes(f, 0))
+		quota, err = zh.GetProperty(f, "quota")
 		ok(t, err)
+		equals(t, "0", quota)
 
-		ok(t, zh.Destroy(s, zfs.DestroyDefault))
+		ok(t, zh.SetReservationBytes(f, uint64(pow2(20))))
+		ok(t, zh.SetReservationBytes(f, 0))
+
+		v, err := zh.CreateVolume("test/size-volume", uint64(pow2(23)), nil)
+		ok(t, err)
+		ok(t, zh.SetVolsizeBytes(v, uint64(pow2(24))))
+		v, err = zh.GetDataset(v.Name)
+		ok(t, err)
+		equals(t, strconv.FormatInt(pow2(24), 10), v.Volsize)
+		assert(t, zh.SetVolsizeBytes(v, 0) != nil, "volsize none should be rejected")
 
+		ok(t, zh.Destroy(v, zfs.DestroyDefault))
 		ok(t, zh.Destroy(f, zfs.DestroyDefault))
 	})
 }
 
-func TestChildren(t *testing.T) {
+func TestResizeVolume(t *testing.T) {
 	zh := getSSHTestHandle()
 	zpoolTest(zh, t, func() {
-		f, err := zh.CreateFilesystem("test/snapshot-test", nil)
+		v, err := zh.CreateVolume("test/resize-volume", uint64(pow2(23)), nil)
 		ok(t, err)
 
-		s, err := zh.Snapshot(f, "test", false)
+		v, err = zh.ResizeVolume(v, uint64(pow2(24)))
 		ok(t, err)
+		equals(t, strconv.FormatInt(pow2(24), 10), v.Volsize)
 
-		equals(t, zfs.DatasetSnapshot, s.Type)
-		equals(t, "test/snapshot-test@test", s.Name)
+		_, err = zh.ResizeVolume(v, uint64(pow2(23)))
+		assert(t, err != nil, "shrinking a volume should be rejected")
 
-		children, err := zh.Children(f, 0)
+		f, err := zh.CreateFilesystem("test/resize-fs", nil)
 		ok(t, err)
+		_, err = zh.ResizeVolume(f, uint64(pow2(24)))
+		assert(t, err != nil, "resizing a filesystem should be rejected")
 
-		equals(t, 1, len(children))
-		equals(t, "test/snapshot-test@test", children[0].Name)
+		ok(t, zh.Destroy(f, zfs.DestroyDefault))
+		ok(t, zh.Destroy(v, zfs.DestroyDefault))
+	})
+}
+
+func TestTuningProperties(t *testing.T) {
+	zh := getSSHTestHandle()
+	zpoolTest(zh, t, func() {
+		f, err := zh.CreateFilesystem("test/tuning-test", nil)
+		ok(t, err)
+		equals(t, "standard", f.Sync)
+		equals(t, "all", f.Primarycache)
+
+		ok(t, zh.SetSync(f, "always"))
+		ok(t, zh.SetLogbias(f, "throughput"))
+		ok(t, zh.SetPrimaryCache(f, "metadata"))
+		ok(t, zh.SetSecondaryCache(f, "none"))
+		f, err = zh.GetDataset(f.Name)
+		ok(t, err)
+		equals(t, "always", f.Sync)
+		equals(t, "throughput", f.Logbias)
+		equals(t, "metadata", f.Primarycache)
+		equals(t, "none", f.Secondarycache)
+
+		assert(t, zh.SetSync(f, "sometimes") != nil, "invalid sync value should be rejected")
+		assert(t, zh.SetPrimaryCache(f, "data") != nil, "invalid primarycache value should be rejected")
 
-		ok(t, zh.Destroy(s, zfs.DestroyDefault))
 		ok(t, zh.Destroy(f, zfs.DestroyDefault))
 	})
 }
 
-func TestListZpool(t *testing.T) {
+func TestSetVolmode(t *testing.T) {
 	zh := getSSHTestHandle()
 	zpoolTest(zh, t, func() {
+		v, err := zh.CreateVolume("test/volmode-volume", uint64(pow2(23)), nil)
+		ok(t, err)
 
-		pools, err := zh.ListZpools()
+		ok(t, zh.SetVolmode(v, "dev"))
+		v, err = zh.GetDataset(v.Name)
 		ok(t, err)
-		var i int
-		var pool *zfs.Zpool
-		for i, pool = range pools {
-			if pool.Name == "test" {
-				break
-			}
+		equals(t, "dev", v.Volmode)
+		assert(t, zh.SetVolmode(v, "block") != nil, "invalid volmode should be rejected")
+
+		f, err := zh.CreateFilesystem("test/volmode-fs", nil)
+		ok(t, err)
+		assert(t, zh.SetVolmode(f, "dev") != nil, "filesystems have no volmode")
+
+		ok(t, zh.Destroy(f, zfs.DestroyDefault))
+		ok(t, zh.Destroy(v, zfs.DestroyDefault))
+	})
+}
+
+func TestTopConsumers(t *testing.T) {
+	zh := getSSHTestHandle()
+	zpoolTest(zh, t, func() {
+		_, err := zh.CreateVolume("test/top-volume", uint64(pow2(23)), nil)
+		ok(t, err)
+
+		top, err := zh.TopConsumers(2)
+		ok(t, err)
+		equals(t, 2, len(top))
+		used0, err := strconv.ParseUint(top[0].Used, 10, 64)
+		ok(t, err)
+		used1, err := strconv.ParseUint(top[1].Used, 10, 64)
+		ok(t, err)
+		assert(t, used0 >= used1, "datasets should be sorted by usage")
+	})
+}
+
+func TestVolumes(t *testing.T) {
+	zh := getSSHTestHandle()
+	zpoolTest(zh, t, func() {
+
+		v, err := zh.CreateVolume("test/volume-test", uint64(pow2(23)), nil)
+		ok(t, err)
+
+		// volumes are sometimes "busy" if you try to manipulate them right away
+		sleep(1)
+
+		equals(t, zfs.DatasetVolume, v.Type)
+		volumes, err := zh.Volumes("", 99)
+		ok(t, err)
+
+		for _, volume := range volumes {
+			equals(t, zfs.DatasetVolume, volume.Type)
 		}
-		equals(t, "test", pools[i].Name)
+
+		ok(t, zh.Destroy(v, zfs.DestroyDefault))
+	})
+}
+func TestSnapshot(t *testing.T) {
+	zh := getSSHTestHandle()
+	zpoolTest(zh, t, func() {
+
+		f, err := zh.CreateFilesystem("test/snapshot-test", nil)
+		ok(t, err)
+
+		filesystems, err := zh.Filesystems("", 99)
+		ok(t, err)
+
+		for _, filesystem := range filesystems {
+			equals(t, zfs.DatasetFilesystem, filesystem.Type)
+		}
+
+		s, err := zh.Snapshot(f, "test", false)
+		ok(t, err)
+
+		equals(t, zfs.DatasetSnapshot, s.Type)
+
+		equals(t, "test/snapshot-test@test", s.Name)
+
+		ok(t, zh.Destroy(s, zfs.DestroyDefault))
+
+		ok(t, zh.Destroy(f,zfs.DestroyDefault))
 	})
 }
 
+func TestSnapshotPath(t *testing.T) {
+	zh := getSSHTestHandle()
+	zpoolTest(zh, t, func() {
+		f, err := zh.CreateFilesystem("test/snapshot-path-test", nil)
+		ok(t, err)
+
+		s, err := zh.Snapshot(f, "test", false)
+		ok(t, err)
+
+		p, err := zh.SnapshotPath(s)
+		ok(t, err)
+		equals(t, f.Mountpoint+"/.zfs/snapshot/test", p)
+
+		ok(t, zh.SetSnapdir(f, true))
+		f, err = zh.GetDataset(f.Name)
+		ok(t, err)
+		equals(t, "visible", f.Snapdir)
+
+		_, err = zh.SnapshotPath(f)
+		assert(t, err != nil, "SnapshotPath should refuse filesystems")
+
+		ok(t, zh.Destroy(s, zfs.DestroyDefault))
+		ok(t, zh.Destroy(f, zfs.DestroyDefault))
+	})
+}
+
+func TestEnsureSnapshot(t *testing.T) {
+	zh := getSSHTestHandle()
+	zpoolTest(zh, t, func() {
+		f, err := zh.CreateFilesystem("test/ensure-test", nil)
+		ok(t, err)
+
+		s1, err := zh.EnsureSnapshot(f, "test", false)
+		ok(t, err)
+		s2, err := zh.EnsureSnapshot(f, "test", false)
+		ok(t, err)
+		equals(t, s1.Name, s2.Name)
+
+		ok(t, zh.Destroy(s1, zfs.DestroyDefault))
+		ok(t, zh.Destroy(f, zfs.DestroyDefault))
+	})
+}
+
+func TestSendFilesystemSuggestsSnapshot(t *testing.T) {
+	zh := getSSHTestHandle()
+	zpoolTest(zh, t, func() {
+		f, err := zh.CreateFilesystem("test/suggest-test", nil)
+		ok(t, err)
+		_, err = zh.Snapshot(f, "one", false)
+		ok(t, err)
+		_, err = zh.Snapshot(f, "two", false)
+		ok(t, err)
+
+		err = zh.SendSnapshot(f.Name, "", ioutil.Discard, zfs.SendDefault, "")
+		assert(t, err != nil && strings.HasSuffix(err.Error(), "did you mean test/suggest-test@two?"),
+			"unexpected error: %v", err)
+
+		ok(t, zh.Destroy(f, zfs.DestroyRecursive))
+	})
+}
+
+func TestSnapshotsWithProperty(t *testing.T) {
+	zh := getSSHTestHandle()
+	zpoolTest(zh, t, func() {
+		f, err := zh.CreateFilesystem("test/tagged-test", nil)
+		ok(t, err)
+		s1, err := zh.Snapshot(f, "one", false)
+		ok(t, err)
+		_, err = zh.Snapshot(f, "two", false)
+		ok(t, err)
+		ok(t, zh.SetProperty(s1, "com.example:retain", "daily"))
+
+		tagged, err := zh.SnapshotsWithProperty(f, "com.example:retain", "daily")
+		ok(t, err)
+		equals(t, 1, len(tagged))
+		equals(t, s1.Name, tagged[0].Name)
+
+		ok(t, zh.Destroy(f, zfs.DestroyRecursive))
+	})
+}
+
+func TestBookmark(t *testing.T) {
+	zh := getSSHTestHandle()
+	zpoolTest(zh, t, func() {
+
+		f, err := zh.CreateFilesystem("test/bookmark-test", nil)
+		ok(t, err)
+
+		s, err := zh.Snapshot(f, "test", false)
+		ok(t, err)
+
+		bm, err := zh.Bookmark(f, "test", false)
+		ok(t, err)
+		equals(t, zfs.DatasetBookmark, bm.Type)
+		equals(t, "test/bookmark-test#test", bm.Name)
+
+		_, err = zh.Bookmark(s, "fromsnap", false)
+		ok(t, err)
+
+		b, err := zh.GetDataset("test/bookmark-test#test")
+		ok(t, err)
+		equals(t, zfs.DatasetBookmark, b.Type)
+		equals(t, "test/bookmark-test#test", b.Name)
+		equals(t, "test", b.DataSetName())
+
+		bookmarks, err := zh.Bookmarks(f, 1)
+		ok(t, err)
+		equals(t, 2, len(bookmarks))
+		equals(t, zfs.DatasetBookmark, bookmarks[0].Type)
+
+		for _, bookmark := range bookmarks {
+			ok(t, zh.Destroy(bookmark, zfs.DestroyDefault))
+		}
+		ok(t, zh.Destroy(s, zfs.DestroyDefault))
+		ok(t, zh.Destroy(f, zfs.DestroyDefault))
+	})
+}
+
+func TestDataSetName(t *testing.T) {
+	var tests = []struct {
+		ds   zfs.Dataset
+		name string
+	}{
+		{zfs.Dataset{Name: "pool/fs@snap", Type: zfs.DatasetSnapshot}, "snap"},
+		{zfs.Dataset{Name: "pool/fs#mark", Type: zfs.DatasetBookmark}, "mark"},
+		{zfs.Dataset{Name: "pool/fs", Type: zfs.DatasetFilesystem}, ""},
+	}
+
+	for _, test := range tests {
+		equals(t, test.name, test.ds.DataSetName())
+	}
+}
+
+func TestSpaceBreakdown(t *testing.T) {
+	ds := zfs.Dataset{
+		Name:                 "pool/fs",
+		Avail:                "1000",
+		Used:                 "600",
+		Usedbysnapshots:      "100",
+		Usedbydataset:        "200",
+		Usedbychildren:       "300",
+		Usedbyrefreservation: "0",
+	}
+	space, err := ds.SpaceBreakdown()
+	ok(t, err)
+	equals(t, zfs.SpaceBreakdown{
+		Avail:           1000,
+		Used:            600,
+		UsedBySnapshots: 100,
+		UsedByDataset:   200,
+		UsedByChildren:  300,
+	}, *space)
+
+	ds.Used = "many"
+	_, err = ds.SpaceBreakdown()
+	assert(t, err != nil, "expected an error for an invalid size")
+}
+
+func TestSnapshotUnique(t *testing.T) {
+	zh := getSSHTestHandle()
+	zpoolTest(zh, t, func() {
+		f, err := zh.CreateFilesystem("test/snapshot-test", nil)
+		ok(t, err)
+
+		s1, err := zh.SnapshotUnique(f, "test", false)
+		ok(t, err)
+		equals(t, "test/snapshot-test@test", s1.Name)
+
+		s2, err := zh.SnapshotUnique(f, "test", false)
+		ok(t, err)
+		equals(t, "test/snapshot-test@test-1", s2.Name)
+
+		ok(t, zh.Destroy(f, zfs.DestroyRecursive))
+	})
+}
+
+func TestClone(t *testing.T) {
+	zh := getSSHTestHandle()
+	zpoolTest(zh, t, func() {
+
+		f, err := zh.CreateFilesystem("test/snapshot-test", nil)
+		ok(t, err)
+
+		filesystems, err := zh.Filesystems("", 99)
+		ok(t, err)
+
+		for _, filesystem := range filesystems {
+			equals(t, zfs.DatasetFilesystem, filesystem.Type)
+		}
+
+		s, err := zh.Snapshot(f, "test", false)
+		ok(t, err)
+
+		equals(t, zfs.DatasetSnapshot, s.Type)
+		equals(t, "test/snapshot-test@test", s.Name)
+
+		c, err := zh.Clone(s, "test/clone-test", nil)
+		ok(t, err)
+
+		equals(t, zfs.DatasetFilesystem, c.Type)
+
+		ok(t, zh.Destroy(c, zfs.DestroyDefault))
+
+		ok(t, zh.Destroy(s, zfs.DestroyDefault))
+
+		ok(t, zh.Destroy(f, zfs.DestroyDefault))
+	})
+}
+
+func TestSendSnapshot(t *testing.T) {
+	zh := getSSHTestHandle()
+	zpoolTest(zh, t, func() {
+		f, err := zh.CreateFilesystem("test/snapshot-test", nil)
+		ok(t, err)
+
+		filesystems, err := zh.Filesystems("", 99)
+		ok(t, err)
+
+		for _, filesystem := range filesystems {
+			equals(t, zfs.DatasetFilesystem, filesystem.Type)
+		}
+
+		s, err := zh.Snapshot(f, "test", false)
+		ok(t, err)
+
+		file, _ := ioutil.TempFile("/tmp/", "zfs-")
+		defer file.Close()
+		err = file.Truncate(pow2(30))
+		ok(t, err)
+		defer os.Remove(file.Name())
+
+		err = zh.SendSnapshot(s.Name, "", file, zfs.SendDefault, "")
+		ok(t, err)
+
+		ok(t, zh.Destroy(s, zfs.DestroyDefault))
+
+		ok(t, zh.Destroy(f, zfs.DestroyDefault))
+	})
+}
+
+func TestSendSnapshotReader(t *testing.T) {
+	zh := getSSHTestHandle()
+	zpoolTest(zh, t, func() {
+		f, err := zh.CreateFilesystem("test/send-reader", nil)
+		ok(t, err)
+		s, err := zh.Snapshot(f, "test", false)
+		ok(t, err)
+
+		stream := zh.SendSnapshotReader(s.Name, "", zfs.SendDefault, "", nil)
+		data, err := ioutil.ReadAll(stream)
+		ok(t, err)
+		ok(t, stream.Close())
+		assert(t, len(data) > 0, "expected a send stream")
+
+		stream = zh.SendSnapshotReader("test/send-reader@missing", "", zfs.SendDefault, "", nil)
+		_, err = ioutil.ReadAll(stream)
+		assert(t, err != nil, "a failed send should fail the read")
+		assert(t, stream.Close() != nil, "a failed send should fail the close")
+
+		ok(t, zh.Destroy(f, zfs.DestroyRecursive))
+	})
+}
+
+func TestSnapshotRangeReclaim(t *testing.T) {
+	zh := getSSHTestHandle()
+	zpoolTest(zh, t, func() {
+		f, err := zh.CreateFilesystem("test/range-test", nil)
+		ok(t, err)
+		file := filepath.Join(f.Mountpoint, "data")
+		ok(t, ioutil.WriteFile(file, bytes.Repeat([]byte("x"), 1<<20), 0644))
+		_, err = zh.Snapshot(f, "one", false)
+		ok(t, err)
+		_, err = zh.Snapshot(f, "two", false)
+		ok(t, err)
+		ok(t, os.Remove(file))
+		_, err = zh.Snapshot(f, "three", false)
+		ok(t, err)
+
+		single, err := zh.SnapshotRangeReclaim(f, "one", "one")
+		ok(t, err)
+		both, err := zh.SnapshotRangeReclaim(f, "one", "two")
+		ok(t, err)
+		assert(t, both > single, "destroying both snapshots should free the shared blocks")
+
+		_, err = zh.SnapshotRangeReclaim(f, "one", "two/x")
+		assert(t, err != nil, "invalid range should be rejected")
+
+		ok(t, zh.Destroy(f, zfs.DestroyRecursive))
+	})
+}
+
+// blockingReader blocks reads until closed.
+type blockingReader chan struct{}
+
+func (b blockingReader) Read(p []byte) (int, error) {
+	<-b
+	return 0, errors.New("closed")
+}
+
+func (b blockingReader) Close() error {
+	close(b)
+	return nil
+}
+
+func TestReceiveSnapshotCancellable(t *testing.T) {
+	zh := getSSHTestHandle()
+	zpoolTest(zh, t, func() {
+		f, err := zh.CreateFilesystem("test/cancel-src", nil)
+		ok(t, err)
+		ok(t, ioutil.WriteFile(filepath.Join(f.Mountpoint, "data"), bytes.Repeat([]byte("data"), 1<<21), 0644))
+		s, err := zh.Snapshot(f, "one", false)
+		ok(t, err)
+		var stream bytes.Buffer
+		ok(t, zh.SendSnapshot(s.Name, "", &stream, zfs.SendDefault, ""))
+
+		block := make(blockingReader)
+		half := bytes.NewReader(stream.Bytes()[:stream.Len()/2])
+		input := struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(half, block), block}
+		recv := zh.ReceiveSnapshotCancellable(input, "test/cancel-dst", "", nil, nil)
+		time.Sleep(time.Second)
+		token, err := recv.Stop()
+		ok(t, err)
+		assert(t, token != "", "stopped receive should leave a resume token")
+		select {
+		case <-block:
+		default:
+			t.Fatal("Stop should close the input")
+		}
+
+		// aborting a full receive removes the dataset
+		zh.AbortReceive("test/cancel-dst")
+		ok(t, zh.Destroy(f, zfs.DestroyRecursive))
+	})
+}
+
+func TestSendSnapshotToConn(t *testing.T) {
+	zh := getSSHTestHandle()
+	zpoolTest(zh, t, func() {
+		f, err := zh.CreateFilesystem("test/conn-src", nil)
+		ok(t, err)
+		s, err := zh.Snapshot(f, "one", false)
+		ok(t, err)
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		ok(t, err)
+		defer l.Close()
+		received := make(chan error, 1)
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				received <- err
+				return
+			}
+			defer conn.Close()
+			_, err = zh.ReceiveSnapshotFromConn(conn, "test/conn-dst", nil)
+			received <- err
+		}()
+
+		conn, err := net.Dial("tcp", l.Addr().String())
+		ok(t, err)
+		ok(t, zh.SendSnapshotToConn(s.Name, "", zfs.SendDefault, conn))
+		conn.Close()
+		ok(t, <-received)
+
+		_, err = zh.GetDataset("test/conn-dst@one")
+		ok(t, err)
+	})
+}
+
+func TestDestroyDryRun(t *testing.T) {
+	zh := getSSHTestHandle()
+	zpoolTest(zh, t, func() {
+		f, err := zh.CreateFilesystem("test/destroy-test", nil)
+		ok(t, err)
+
+		s, err := zh.Snapshot(f, "test", false)
+		ok(t, err)
+
+		names, err := zh.DestroyList(f, zfs.DestroyRecursive|zfs.DestroyDryRun)
+		ok(t, err)
+		equals(t, 2, len(names))
+
+		_, err = zh.GetDataset(s.Name)
+		ok(t, err)
+
+		names, err = zh.DestroyList(f, zfs.DestroyRecursive)
+		ok(t, err)
+		equals(t, 2, len(names))
+
+		_, err = zh.GetDataset(f.Name)
+		assert(t, err != nil, "filesystem should have been destroyed")
+	})
+}
+
+func createEncryptedFilesystem(zh *zfs.ZfsH, t *testing.T, name string) *zfs.Dataset {
+	key, err := ioutil.TempFile("/tmp/", "zfs-key-")
+	ok(t, err)
+	defer key.Close()
+	_, err = key.WriteString("test-passphrase")
+	ok(t, err)
+
+	f, err := zh.CreateFilesystem(name, map[string]string{
+		"encryption":  "on",
+		"keyformat":   "passphrase",
+		"keylocation": "file://" + key.Name(),
+	})
+	ok(t, err)
+	return f
+}
+
+func TestReceiveIntoEncryptedParent(t *testing.T) {
+	zh := getSSHTestHandle()
+	zpoolTest(zh, t, func() {
+		enc := createEncryptedFilesystem(zh, t, "test/encrypted")
+
+		f, err := zh.CreateFilesystem("test/plain", nil)
+		ok(t, err)
+		s, err := zh.Snapshot(f, "test", false)
+		ok(t, err)
+
+		var stream bytes.Buffer
+		ok(t, zh.SendSnapshot(s.Name, "", &stream, zfs.SendProps, ""))
+
+		_, err = zh.ReceiveSnapshot(&stream, "test/encrypted/plain@test", "", nil)
+		ok(t, err)
+
+		child, err := zh.GetDataset("test/encrypted/plain")
+		ok(t, err)
+		root, err := zh.GetProperty(child, "encryptionroot")
+		ok(t, err)
+		equals(t, enc.Name, root)
+
+		ok(t, zh.Destroy(child, zfs.DestroyRecursive))
+
+		// with -e, the encrypted dataset is the parent of the destination
+		stream.Reset()
+		ok(t, zh.SendSnapshot(s.Name, "", &stream, zfs.SendDefault, ""))
+		e, err := zh.ReceiveSnapshot(&stream, enc.Name, "", nil, "-e")
+		ok(t, err)
+		root, err = zh.GetProperty(e, "encryptionroot")
+		ok(t, err)
+		equals(t, enc.Name, root)
+
+		ok(t, zh.Destroy(enc, zfs.DestroyRecursive))
+		ok(t, zh.Destroy(f, zfs.DestroyRecursive))
+	})
+}
+
+func TestReceiveEncryptionMismatch(t *testing.T) {
+	zh := getSSHTestHandle()
+	zpoolTest(zh, t, func() {
+		enc := createEncryptedFilesystem(zh, t, "test/encrypted")
+		s, err := zh.Snapshot(enc, "test", false)
+		ok(t, err)
+
+		f, err := zh.CreateFilesystem("test/plain", nil)
+		ok(t, err)
+
+		var stream bytes.Buffer
+		ok(t, zh.SendSnapshot(s.Name, "", &stream, zfs.SendRaw, ""))
+
+		// zfs refuses to overwrite an unencrypted dataset with a raw stream
+		_, err = zh.ReceiveSnapshot(&stream, "test/plain", "", nil, "-F")
+		assert(t, errors.Is(err, zfs.ErrEncryptionMismatch), "expected ErrEncryptionMismatch, got: %v", err)
+
+		ok(t, zh.Destroy(enc, zfs.DestroyRecursive))
+		ok(t, zh.Destroy(f, zfs.DestroyRecursive))
+	})
+}
+
+func TestReceiveWithCompression(t *testing.T) {
+	zh := getSSHTestHandle()
+	zpoolTest(zh, t, func() {
+		f, err := zh.CreateFilesystem("test/recompress-src", map[string]string{"compression": "lz4"})
+		ok(t, err)
+		s, err := zh.Snapshot(f, "one", false)
+		ok(t, err)
+
+		var stream bytes.Buffer
+		ok(t, zh.SendSnapshot(s.Name, "", &stream, zfs.SendDefault, ""))
+		d, err := zh.ReceiveWithCompression(&stream, "test/recompress-dst", "gzip", nil)
+		ok(t, err)
+		equals(t, "gzip", d.Compression)
+
+		enc := createEncryptedFilesystem(zh, t, "test/recompress-encrypted")
+		es, err := zh.Snapshot(enc, "one", false)
+		ok(t, err)
+		stream.Reset()
+		ok(t, zh.SendSnapshot(es.Name, "", &stream, zfs.SendRaw, ""))
+		_, err = zh.ReceiveWithCompression(&stream, "test/recompress-raw", "gzip", nil)
+		assert(t, errors.Is(err, zfs.ErrRawStream), "expected ErrRawStream, got: %v", err)
+
+		stream.Reset()
+		ok(t, zh.SendSnapshot(s.Name, "", &stream, zfs.SendLz4, ""))
+		_, err = zh.ReceiveWithCompression(&stream, "test/recompress-lz4", "gzip", nil)
+		assert(t, errors.Is(err, zfs.ErrCompressedStream), "expected ErrCompressedStream, got: %v", err)
+
+		ok(t, zh.Destroy(f, zfs.DestroyRecursive))
+		ok(t, zh.Destroy(d, zfs.DestroyRecursive))
+		ok(t, zh.Destroy(enc, zfs.DestroyRecursive))
+	})
+}
+
+func TestReplicateTo(t *testing.T) {
+	zh := getSSHTestHandle()
+	zpoolTest(zh, t, func() {
+		f, err := zh.CreateFilesystem("test/replicate-src", nil)
+		ok(t, err)
+		s1, err := zh.Snapshot(f, "one", false)
+		ok(t, err)
+		s2, err := zh.Snapshot(f, "two", false)
+		ok(t, err)
+
+		opts := zfs.ReplicateOptions{BufferSize: 1 << 20}
+		ok(t, zh.ReplicateTo(zh, s1.Name, "", "test/replicate-dst@one", opts))
+		ok(t, zh.ReplicateTo(zh, s2.Name, s1.Name, "test/replicate-dst@two", opts))
+
+		_, err = zh.GetDataset("test/replicate-dst@two")
+		ok(t, err)
+
+		err = zh.ReplicateTo(zh, s2.Name, s1.Name, "test/replicate-dst@two", opts)
+		assert(t, err != nil, "replicating an existing snapshot should fail")
+
+		ok(t, zh.Destroy(f, zfs.DestroyRecursive))
+		d, err := zh.GetDataset("test/replicate-dst")
+		ok(t, err)
+		ok(t, zh.Destroy(d, zfs.DestroyRecursive))
+	})
+}
+
+func TestReceiveStream(t *testing.T) {
+	zh := getSSHTestHandle()
+	zpoolTest(zh, t, func() {
+		f, err := zh.CreateFilesystem("test/stream-src", nil)
+		ok(t, err)
+		_, err = zh.CreateFilesystem("test/stream-src/child", nil)
+		ok(t, err)
+		s, err := zh.Snapshot(f, "one", true)
+		ok(t, err)
+
+		var stream bytes.Buffer
+		ok(t, zh.SendSnapshot(s.Name, "", &stream, zfs.SendRecursive, ""))
+
+		received, err := zh.ReceiveStream(&stream, "test/stream-dst", "", nil, nil)
+		ok(t, err)
+		equals(t, 2, len(received))
+		equals(t, "test/stream-dst@one", received[0].Name)
+		equals(t, "test/stream-dst/child@one", received[1].Name)
+
+		ok(t, zh.Destroy(f, zfs.DestroyRecursive))
+		d, err := zh.GetDataset("test/stream-dst")
+		ok(t, err)
+		ok(t, zh.Destroy(d, zfs.DestroyRecursive))
+	})
+}
+
+func TestReceiveRemapped(t *testing.T) {
+	zh := getSSHTestHandle()
+	zpoolTest(zh, t, func() {
+		f, err := zh.CreateFilesystem("test/remap-src", nil)
+		ok(t, err)
+		s, err := zh.Snapshot(f, "one", false)
+		ok(t, err)
+		dst, err := zh.CreateFilesystem("test/remap-dst", nil)
+		ok(t, err)
+
+		var stream bytes.Buffer
+		ok(t, zh.SendSnapshot(s.Name, "", &stream, zfs.SendDefault, ""))
+		sent := stream.Bytes()
+
+		// -d keeps the sent name without its pool
+		d, err := zh.ReceiveSnapshot(bytes.NewReader(sent), dst.Name, "", nil, "-d")
+		ok(t, err)
+		equals(t, "test/remap-dst/remap-src", d.Name)
+		equals(t, zfs.DatasetFilesystem, d.Type)
+
+		// -e keeps only the last element of the sent name
+		parent, err := zh.CreateFilesystem("test/remap-dst/e", nil)
+		ok(t, err)
+		e, err := zh.ReceiveSnapshot(bytes.NewReader(sent), parent.Name, "", nil, "-e")
+		ok(t, err)
+		equals(t, "test/remap-dst/e/remap-src", e.Name)
+
+		ok(t, zh.Destroy(f, zfs.DestroyRecursive))
+		ok(t, zh.Destroy(dst, zfs.DestroyRecursive))
+	})
+}
+
+func TestReceiveNoMount(t *testing.T) {
+	zh := getSSHTestHandle()
+	zpoolTest(zh, t, func() {
+		f, err := zh.CreateFilesystem("test/nomount-src", nil)
+		ok(t, err)
+		s, err := zh.Snapshot(f, "one", false)
+		ok(t, err)
+
+		var stream bytes.Buffer
+		ok(t, zh.SendSnapshot(s.Name, "", &stream, zfs.SendDefault, ""))
+
+		opts := &zfs.StreamOptions{ReceiveFlags: zfs.ReceiveNoMount}
+		_, err = zh.ReceiveSnapshotWithOptions(&stream, "test/nomount-dst", "", nil, opts)
+		ok(t, err)
+
+		d, err := zh.GetDataset("test/nomount-dst")
+		ok(t, err)
+		equals(t, "noauto", d.Canmount)
+		mounted, err := zh.GetProperty(d, "mounted")
+		ok(t, err)
+		equals(t, "no", mounted)
+
+		ok(t, zh.Destroy(f, zfs.DestroyRecursive))
+		ok(t, zh.Destroy(d, zfs.DestroyRecursive))
+	})
+}
+
+func TestDestroyPromoteClones(t *testing.T) {
+	zh := getSSHTestHandle()
+	zpoolTest(zh, t, func() {
+		f, err := zh.CreateFilesystem("test/promote-src", nil)
+		ok(t, err)
+		s, err := zh.Snapshot(f, "one", false)
+		ok(t, err)
+		c, err := zh.Clone(s, "test/promote-clone", nil)
+		ok(t, err)
+
+		hasClones, err := zh.HasClones(s)
+		ok(t, err)
+		assert(t, hasClones, "snapshot should have clones")
+
+		ok(t, zh.Destroy(f, zfs.DestroyRecursive|zfs.DestroyPromoteClones))
+
+		_, err = zh.GetDataset("test/promote-clone@one")
+		ok(t, err)
+		ok(t, zh.Destroy(c, zfs.DestroyRecursive))
+	})
+}
+
+func TestIsClone(t *testing.T) {
+	zh := getSSHTestHandle()
+	zpoolTest(zh, t, func() {
+		f, err := zh.CreateFilesystem("test/origin-src", nil)
+		ok(t, err)
+		assert(t, !f.IsClone(), "filesystem should not be a clone")
+		s, err := zh.Snapshot(f, "one", false)
+		ok(t, err)
+		c, err := zh.Clone(s, "test/origin-clone", nil)
+		ok(t, err)
+		c, err = zh.GetDataset(c.Name)
+		ok(t, err)
+		assert(t, c.IsClone(), "clone should be a clone")
+		cs, err := zh.Snapshot(c, "two", false)
+		ok(t, err)
+		cc, err := zh.Clone(cs, "test/origin-clone2", nil)
+		ok(t, err)
+
+		origins, err := zh.Origins(cc)
+		ok(t, err)
+		equals(t, []string{"test/origin-clone@two", "test/origin-src@one"}, origins)
+
+		clones, err := zh.Clones(f)
+		ok(t, err)
+		equals(t, []string{"test/origin-clone"}, clones)
+
+		ok(t, zh.Destroy(f, zfs.DestroyRecursiveClones))
+	})
+}
+
+func TestRedact(t *testing.T) {
+	zh := getSSHTestHandle()
+	zpoolTest(zh, t, func() {
+		f, err := zh.CreateFilesystem("test/redact-src", nil)
+		ok(t, err)
+		s, err := zh.Snapshot(f, "one", false)
+		ok(t, err)
+		c, err := zh.Clone(s, "test/redact-clone", nil)
+		ok(t, err)
+		_, err = zh.Snapshot(c, "redact", false)
+		ok(t, err)
+		other, err := zh.Snapshot(f, "other", false)
+		ok(t, err)
+
+		_, err = zh.Redact(s, "book", []string{other.Name})
+		assert(t, err != nil, "a snapshot of the source is no redaction snapshot")
+
+		b, err := zh.Redact(s, "book", []string{"test/redact-clone@redact"})
+		if errors.Is(err, zfs.ErrFeatureUnsupported) {
+			t.Skip("redaction bookmarks are not supported")
+		}
+		ok(t, err)
+		equals(t, "test/redact-src#book", b.Name)
+		equals(t, zfs.DatasetBookmark, b.Type)
+
+		ok(t, zh.Destroy(f, zfs.DestroyRecursiveClones))
+	})
+}
+
+func TestSwapDatasets(t *testing.T) {
+	zh := getSSHTestHandle()
+	zpoolTest(zh, t, func() {
+		blue, err := zh.CreateFilesystem("test/blue", map[string]string{"org.test:color": "blue"})
+		ok(t, err)
+		green, err := zh.CreateFilesystem("test/green", map[string]string{"org.test:color": "green"})
+		ok(t, err)
+
+		ok(t, zh.SwapDatasets(blue, green))
+		equals(t, "test/green", blue.Name)
+		equals(t, "test/blue", green.Name)
+
+		color, err := zh.GetProperty(green, "org.test:color")
+		ok(t, err)
+		equals(t, "green", color)
+		_, err = zh.GetDataset("test/blue-swap")
+		assert(t, err != nil, "temporary dataset should be gone")
+
+		ok(t, zh.Destroy(blue, zfs.DestroyDefault))
+		ok(t, zh.Destroy(green, zfs.DestroyDefault))
+	})
+}
+
+func TestHolds(t *testing.T) {
+	zh := getSSHTestHandle()
+	zpoolTest(zh, t, func() {
+		f, err := zh.CreateFilesystem("test/holds", nil)
+		ok(t, err)
+		_, err = zh.CreateFilesystem("test/holds/child", nil)
+		ok(t, err)
+		s, err := zh.Snapshot(f, "one", true)
+		ok(t, err)
+		ok(t, zh.Hold(s, "keep", true))
+
+		holds, err := zh.Holds(s)
+		ok(t, err)
+		equals(t, []string{"keep"}, holds)
+
+		all, err := zh.HoldsRecursive(f)
+		ok(t, err)
+		equals(t, map[string][]string{
+			"test/holds@one":       {"keep"},
+			"test/holds/child@one": {"keep"},
+		}, all)
+
+		ok(t, zh.Release(s, "keep", true))
+		all, err = zh.HoldsRecursive(s)
+		ok(t, err)
+		equals(t, 0, len(all))
+
+		ok(t, zh.Destroy(f, zfs.DestroyRecursive))
+	})
+}
+
+func TestChildren(t *testing.T) {
+	zh := getSSHTestHandle()
+	zpoolTest(zh, t, func() {
+		f, err := zh.CreateFilesystem("test/snapshot-test", nil)
+		ok(t, err)
+
+		s, err := zh.Snapshot(f, "test", false)
+		ok(t, err)
+
+		equals(t, zfs.DatasetSnapshot, s.Type)
+		equals(t, "test/snapshot-test@test", s.Name)
+
+		children, err := zh.Children(f, 0)
+		ok(t, err)
+
+		equals(t, 1, len(children))
+		equals(t, "test/snapshot-test@test", children[0].Name)
+
+		ok(t, zh.Destroy(s, zfs.DestroyDefault))
+		ok(t, zh.Destroy(f, zfs.DestroyDefault))
+	})
+}
+
+func TestChildrenNotFound(t *testing.T) {
+	zh := getSSHTestHandle()
+	zpoolTest(zh, t, func() {
+		_, err := zh.Children(&zfs.Dataset{Name: "test/vanished"}, 0)
+		assert(t, errors.Is(err, zfs.ErrDatasetNotFound), "expected ErrDatasetNotFound, got: %v", err)
+	})
+}
+
+func TestListZpool(t *testing.T) {
+	zh := getSSHTestHandle()
+	zpoolTest(zh, t, func() {
+
+		pools, err := zh.ListZpools()
+		ok(t, err)
+		var i int
+		var pool *zfs.Zpool
+		for i, pool = range pools {
+			if pool.Name == "test" {
+				break
+			}
+		}
+		equals(t, "test", pools[i].Name)
+	})
+}
+
+func TestReguid(t *testing.T) {
+	zh := getSSHTestHandle()
+	zpoolTest(zh, t, func() {
+		pool, err := zh.GetZpool("test")
+		ok(t, err)
+		assert(t, pool.Guid != "", "pool guid should be set")
+
+		guid := pool.Guid
+		ok(t, zh.Reguid(pool))
+		assert(t, pool.Guid != guid, "pool guid should have changed")
+	})
+}
+
+func TestWaitForScrub(t *testing.T) {
+	zh := getSSHTestHandle()
+	zpoolTest(zh, t, func() {
+		pool, err := zh.GetZpool("test")
+		ok(t, err)
+
+		info, err := zh.WaitForScrub(pool, time.Second, time.Minute)
+		ok(t, err)
+		equals(t, zfs.ScanNone, info.State)
+	})
+}
+
+func TestCreateZpoolWithOptions(t *testing.T) {
+	zh := getSSHTestHandle()
+	f, err := ioutil.TempFile("/tmp/", "zfs-")
+	ok(t, err)
+	defer os.Remove(f.Name())
+	ok(t, f.Truncate(pow2(30)))
+	f.Close()
+
+	opts := zfs.ZpoolCreateOptions{Altroot: "/tmp/altroot", Mountpoint: "/data", Ashift: 12}
+	pool, err := zh.CreateZpoolWithOptions("withoptions", opts, f.Name())
+	ok(t, err)
+	defer zh.DestroyZpool(pool)
+
+	root, err := zh.GetDataset("withoptions")
+	ok(t, err)
+	equals(t, "/tmp/altroot/data", root.Mountpoint)
+}
+
+func TestLabelClear(t *testing.T) {
+	zh := getSSHTestHandle()
+	f, err := ioutil.TempFile("/tmp/", "zfs-")
+	ok(t, err)
+	defer os.Remove(f.Name())
+	ok(t, f.Truncate(pow2(30)))
+	f.Close()
+
+	pool, err := zh.CreateZpool("labelclear", nil, f.Name())
+	ok(t, err)
+	ok(t, zh.DestroyZpool(pool))
+
+	ok(t, zh.LabelClear(f.Name(), false))
+}
+
 func TestRollback(t *testing.T) {
 	zh := getSSHTestHandle()
 	zpoolTest(zh, t, func() {
@@ -1,7 +1,11 @@
 package zfs
 
 import (
+	"errors"
+	"fmt"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // ZFS zpool states, which can indicate if a pool is online, offline,
@@ -25,17 +29,43 @@ type Zpool struct {
 	Allocated string
 	Size      string
 	Free      string
+	Guid      string
+}
+
+// String returns a short description of the pool: name (health, alloc/size).
+func (zp *Zpool) String() string {
+	return fmt.Sprintf("%s (%s, %s/%s)", zp.Name, zp.Health, zp.Allocated, zp.Size)
+}
+
+// Format implements fmt.Formatter so that %+v and %#v still print all the
+// fields of the pool.
+func (zp *Zpool) Format(f fmt.State, verb rune) {
+	type zpool Zpool
+	formatStringer(f, verb, zp, (*zpool)(zp))
 }
 
 // zpool is a helper function to wrap typical calls to zpool.
 func (z *ZfsH) zpool(arg ...string) ([][]string, error) {
 	c := &command{
-		Command: "zpool",
+		Command: z.wrap("zpool"),
 		zh: z,
 	}
 	return c.Run(arg...)
 }
 
+// zpoolOutput runs zpool and returns its raw standard output, for commands
+// whose output is not a simple table.
+func (z *ZfsH) zpoolOutput(arg ...string) (string, error) {
+	c := &command{
+		Command: z.wrap("zpool"),
+		zh: z,
+	}
+	if _, err := c.Run(arg...); err != nil {
+		return "", err
+	}
+	return c.stdout.String(), nil
+}
+
 // GetZpool retrieves a single ZFS zpool by name.
 func (z *ZfsH) GetZpool(name string) (*Zpool, error) {
 	out, err := z.zpool("list", "-o", strings.Join(ZpoolPropList, ","), name)
@@ -59,9 +89,24 @@ func (z *ZfsH) GetZpool(name string) (*Zpool, error) {
 // and optional arguments.
 // A full list of available ZFS properties and command-line arguments may be
 // found here: https://www.freebsd.org/cgi/man.cgi?zfs(8).
+// If a device contains a filesystem or is part of another pool the returned
+// error wraps ErrDeviceInUse, see CreateZpoolForce.
 func (z *ZfsH) CreateZpool(name string, properties map[string]string, args ...string) (*Zpool, error) {
+	return z.createZpool(name, properties, false, args...)
+}
+
+// CreateZpoolForce creates a new ZFS zpool like CreateZpool, but forces the
+// use of devices which contain a filesystem or labels of another pool.
+func (z *ZfsH) CreateZpoolForce(name string, properties map[string]string, args ...string) (*Zpool, error) {
+	return z.createZpool(name, properties, true, args...)
+}
+
+func (z *ZfsH) createZpool(name string, properties map[string]string, force bool, args ...string) (*Zpool, error) {
 	cli := make([]string, 1, 4)
 	cli[0] = "create"
+	if force {
+		cli = append(cli, "-f")
+	}
 	if properties != nil {
 		cli = append(cli, propsSlice(properties)...)
 	}
@@ -69,12 +114,190 @@ func (z *ZfsH) CreateZpool(name string, properties map[string]string, args ...st
 	cli = append(cli, args...)
 	_, err := z.zpool(cli...)
 	if err != nil {
+		if !force {
+			err = classifyError(err, ErrDeviceInUse, "use '-f' to override", "contains a filesystem", "is part of")
+		}
 		return nil, err
 	}
 
 	return &Zpool{Name: name}, nil
 }
 
+// ZpoolCreateOptions holds the settings of CreateZpoolWithOptions.
+type ZpoolCreateOptions struct {
+	// Mountpoint of the root dataset of the pool (-m), the default is
+	// /<name>.
+	Mountpoint string
+	// Altroot is prepended to all mountpoints of the pool (-R), e.g. to
+	// install into a chroot.  It implies cachefile=none.
+	Altroot string
+	// Ashift sets the sector size of the vdevs to 2^Ashift bytes, 0 lets
+	// zpool detect it.
+	Ashift int
+	// Force uses devices which contain a filesystem or labels of another
+	// pool (-f).
+	Force bool
+	// Properties are further pool properties.
+	Properties map[string]string
+}
+
+// CreateZpoolWithOptions creates a new ZFS zpool on the given devices or
+// vdev specification, such as "mirror", "/dev/sda", "/dev/sdb".  As with
+// CreateZpool, a device in use is reported with ErrDeviceInUse unless
+// opts.Force is set.
+func (z *ZfsH) CreateZpoolWithOptions(name string, opts ZpoolCreateOptions, devices ...string) (*Zpool, error) {
+	if opts.Ashift != 0 && (opts.Ashift < 9 || opts.Ashift > 16) {
+		return nil, fmt.Errorf("invalid ashift %d: must be from 9 to 16", opts.Ashift)
+	}
+	cli := []string{"create"}
+	if opts.Force {
+		cli = append(cli, "-f")
+	}
+	if opts.Mountpoint != "" {
+		cli = append(cli, "-m", opts.Mountpoint)
+	}
+	if opts.Altroot != "" {
+		cli = append(cli, "-R", opts.Altroot)
+	}
+	if opts.Ashift != 0 {
+		cli = append(cli, "-o", fmt.Sprintf("ashift=%d", opts.Ashift))
+	}
+	if opts.Properties != nil {
+		cli = append(cli, propsSlice(opts.Properties)...)
+	}
+	cli = append(cli, name)
+	cli = append(cli, devices...)
+	_, err := z.zpool(cli...)
+	if err != nil {
+		if !opts.Force {
+			err = classifyError(err, ErrDeviceInUse, "use '-f' to override", "contains a filesystem", "is part of")
+		}
+		return nil, err
+	}
+	return &Zpool{Name: name}, nil
+}
+
+// CreateZpoolDryRun validates the creation of a ZFS zpool with the specified
+// name, properties and optional arguments without creating it (zpool create
+// -n).  It returns the configuration zpool would create, or an error if the
+// layout is invalid, e.g. because of mismatched replication levels.
+func (z *ZfsH) CreateZpoolDryRun(name string, properties map[string]string, args ...string) (string, error) {
+	cli := make([]string, 2, 5)
+	cli[0] = "create"
+	cli[1] = "-n"
+	if properties != nil {
+		cli = append(cli, propsSlice(properties)...)
+	}
+	cli = append(cli, name)
+	cli = append(cli, args...)
+	return z.zpoolOutput(cli...)
+}
+
+// Reguid generates a new unique identifier for a zpool.  Pools cloned at the
+// block level share their GUID, and must be reguided before both can be
+// imported on the same system.  The Guid of zp is updated accordingly.
+func (z *ZfsH) Reguid(zp *Zpool) error {
+	if _, err := z.zpool("reguid", zp.Name); err != nil {
+		return err
+	}
+	updated, err := z.GetZpool(zp.Name)
+	if err != nil {
+		return err
+	}
+	zp.Guid = updated.Guid
+	return nil
+}
+
+// LabelClear removes the ZFS label information from device, so that a disk
+// of a destroyed or exported pool can be reused.  Without force, devices
+// still belonging to an exported or foreign pool are refused with
+// ErrDeviceInUse.
+func (z *ZfsH) LabelClear(device string, force bool) error {
+	args := []string{"labelclear"}
+	if force {
+		args = append(args, "-f")
+	}
+	args = append(args, device)
+	_, err := z.zpool(args...)
+	if err != nil && !force {
+		err = classifyError(err, ErrDeviceInUse, "use '-f' to override", "is a member of", "is part of")
+	}
+	return err
+}
+
+// Checkpoint takes a checkpoint of a zpool, a snapshot of the whole pool
+// state which it can later be rewound to by importing it with
+// RewindToCheckpoint, e.g. before a risky pool-wide operation.  A pool has
+// at most one checkpoint.
+func (z *ZfsH) Checkpoint(zp *Zpool) error {
+	_, err := z.zpool("checkpoint", zp.Name)
+	return err
+}
+
+// DiscardCheckpoint discards the checkpoint of a zpool, freeing the space
+// it holds.
+func (z *ZfsH) DiscardCheckpoint(zp *Zpool) error {
+	_, err := z.zpool("checkpoint", "-d", zp.Name)
+	return err
+}
+
+// CheckpointSpace reports whether a zpool has a checkpoint, and the space in
+// bytes held by it.
+func (z *ZfsH) CheckpointSpace(zp *Zpool) (uint64, bool, error) {
+	out, err := z.zpoolOutput("list", "-Hp", "-o", "checkpoint", zp.Name)
+	if err != nil {
+		return 0, false, err
+	}
+	val := strings.TrimSpace(out)
+	if val == "-" {
+		return 0, false, nil
+	}
+	size, err := strconv.ParseUint(val, 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("Unexpected zpool list output: %q", out)
+	}
+	return size, true, nil
+}
+
+// ExportZpool exports a zpool, so that it can be imported again, possibly
+// on another system.
+func (z *ZfsH) ExportZpool(zp *Zpool) error {
+	_, err := z.zpool("export", zp.Name)
+	return err
+}
+
+// ZpoolImportOptions tunes ImportZpool.
+type ZpoolImportOptions struct {
+	// Dirs are searched for the devices of the pool (-d), e.g. for pools on
+	// files.  The default is /dev.
+	Dirs []string
+	// RewindToCheckpoint imports the pool rewound to its checkpoint,
+	// discarding every change made after it.
+	RewindToCheckpoint bool
+	// Force imports a pool which appears to be in use by another system
+	// (-f).
+	Force bool
+}
+
+// ImportZpool imports the exported zpool name.
+func (z *ZfsH) ImportZpool(name string, opts ZpoolImportOptions) (*Zpool, error) {
+	args := []string{"import"}
+	for _, dir := range opts.Dirs {
+		args = append(args, "-d", dir)
+	}
+	if opts.RewindToCheckpoint {
+		args = append(args, "--rewind-to-checkpoint")
+	}
+	if opts.Force {
+		args = append(args, "-f")
+	}
+	args = append(args, name)
+	if _, err := z.zpool(args...); err != nil {
+		return nil, err
+	}
+	return z.GetZpool(name)
+}
+
 // Destroy destroys a ZFS zpool by name.
 func (z *ZfsH) DestroyZpool(zp *Zpool) error {
 	_, err := z.zpool("destroy", zp.Name)
@@ -100,3 +323,239 @@ func (z *ZfsH) ListZpools() ([]*Zpool, error) {
 	}
 	return pools, nil
 }
+
+// SystemInventory is the state of all zpools of a system along with their
+// datasets, see Inventory.
+type SystemInventory struct {
+	Pools []*PoolInventory
+}
+
+// PoolInventory is a zpool along with its datasets by type, each in the
+// order of zfs list.
+type PoolInventory struct {
+	Pool        *Zpool
+	Filesystems []*Dataset
+	Volumes     []*Dataset
+	Snapshots   []*Dataset
+	Bookmarks   []*Dataset
+}
+
+// Inventory returns all zpools and their filesystems, volumes, snapshots and
+// bookmarks, listing the datasets of each pool with a single command.
+func (z *ZfsH) Inventory() (*SystemInventory, error) {
+	pools, err := z.ListZpools()
+	if err != nil {
+		return nil, err
+	}
+	inventory := &SystemInventory{}
+	for _, zp := range pools {
+		datasets, err := z.listByType("all", zp.Name, -1, true)
+		if err != nil {
+			return nil, err
+		}
+		pool := &PoolInventory{Pool: zp}
+		for _, ds := range datasets {
+			switch ds.Type {
+			case DatasetFilesystem:
+				pool.Filesystems = append(pool.Filesystems, ds)
+			case DatasetVolume:
+				pool.Volumes = append(pool.Volumes, ds)
+			case DatasetSnapshot:
+				pool.Snapshots = append(pool.Snapshots, ds)
+			case DatasetBookmark:
+				pool.Bookmarks = append(pool.Bookmarks, ds)
+			}
+		}
+		inventory.Pools = append(inventory.Pools, pool)
+	}
+	return inventory, nil
+}
+
+// UnhealthyStatus returns the summary of zpool status -x, which only
+// describes unhealthy pools, and whether all pools are healthy.  This is
+// much cheaper than inspecting every pool, e.g. for a health probe.  A
+// system without pools is healthy.
+func (z *ZfsH) UnhealthyStatus() (string, bool, error) {
+	out, err := z.zpoolOutput("status", "-x")
+	if err != nil {
+		return "", false, err
+	}
+	summary := strings.TrimSpace(out)
+	healthy := summary == "all pools are healthy" || summary == "no pools available"
+	return summary, healthy, nil
+}
+
+// Scan states reported in ScrubInfo.State.
+const (
+	ScanNone       = "none"
+	ScanInProgress = "in progress"
+	ScanPaused     = "paused"
+	ScanFinished   = "finished"
+	ScanCanceled   = "canceled"
+)
+
+// ScrubInfo describes the last scrub or resilver of a zpool, as reported on
+// the "scan:" line of zpool status.
+type ScrubInfo struct {
+	// Function is "scrub" or "resilver", or empty if no scan was requested.
+	Function string
+	State    string
+	// Started is set while a scan is in progress or paused.
+	Started time.Time
+	// Completed is set once a scan has finished or was canceled.
+	Completed time.Time
+	Duration  time.Duration
+	// Scanned is the number of bytes scanned so far while in progress, or
+	// the number of bytes resilvered for a finished resilver.
+	Scanned  uint64
+	Repaired uint64
+	Errors   uint64
+	// Raw is the unparsed text of the scan line.
+	Raw string
+}
+
+// LastScrub returns information about the last scrub or resilver of a zpool.
+func (z *ZfsH) LastScrub(zp *Zpool) (*ScrubInfo, error) {
+	out, err := z.zpoolOutput("status", zp.Name)
+	if err != nil {
+		return nil, err
+	}
+	return parseScanStatus(out)
+}
+
+// WaitForScrub polls the scrub or resilver of a zpool every poll interval
+// until it is no longer in progress or paused, and returns its final state.
+// This works with zfs versions lacking zpool wait.  If it does not finish
+// within timeout, or 0 for no limit, ErrTimeout is returned along with the
+// last state seen.  A canceled scan is reported as an error.  Waiting ends
+// with the context error once the context of the handle is done, see
+// WithContext.
+func (z *ZfsH) WaitForScrub(zp *Zpool, poll time.Duration, timeout time.Duration) (*ScrubInfo, error) {
+	if poll <= 0 {
+		return nil, errors.New("poll interval must be positive")
+	}
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	for {
+		info, err := z.LastScrub(zp)
+		if err != nil {
+			return nil, err
+		}
+		switch info.State {
+		case ScanInProgress, ScanPaused:
+		case ScanCanceled:
+			return info, fmt.Errorf("%s of %s was canceled", info.Function, zp.Name)
+		default:
+			return info, nil
+		}
+		if !deadline.IsZero() && time.Now().Add(poll).After(deadline) {
+			return info, ErrTimeout
+		}
+		select {
+		case <-time.After(poll):
+		case <-z.context().Done():
+			return info, z.context().Err()
+		}
+	}
+}
+
+// DedupInfo describes the dedup table (DDT) of a zpool.
+type DedupInfo struct {
+	// Entries is the number of entries of the DDT.
+	Entries uint64
+	// EntrySizeOnDisk and EntrySizeInCore are the sizes of a DDT entry in
+	// bytes, so that Entries*EntrySizeInCore is the memory the DDT needs.
+	EntrySizeOnDisk uint64
+	EntrySizeInCore uint64
+	// Ratio is the dedupratio of the pool, e.g. 1.5 for 1.50x.
+	Ratio float64
+}
+
+// DedupStats returns the dedup table statistics of a zpool, as shown by
+// zpool status -D, along with its dedup ratio.
+func (z *ZfsH) DedupStats(zp *Zpool) (*DedupInfo, error) {
+	out, err := z.zpoolOutput("status", "-D", zp.Name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := parseDedupStatus(out)
+	if err != nil {
+		return nil, err
+	}
+	ratio, err := z.zpoolOutput("get", "-Hp", "-o", "value", "dedupratio", zp.Name)
+	if err != nil {
+		return nil, err
+	}
+	info.Ratio, err = strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(ratio), "x"), 64)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid dedupratio '%s': %v", strings.TrimSpace(ratio), err)
+	}
+	return info, nil
+}
+
+// PermanentErrors returns the files affected by permanent errors in a zpool,
+// as listed by zpool status -v.  Entries are either paths, or dataset:object
+// pairs for files which could not be resolved.  The slice is empty if the
+// pool has no known data errors.
+func (z *ZfsH) PermanentErrors(zp *Zpool) ([]string, error) {
+	out, err := z.zpoolOutput("status", "-v", zp.Name)
+	if err != nil {
+		return nil, err
+	}
+	return parsePermanentErrors(out), nil
+}
+
+// Feature is a zpool feature flag.
+type Feature struct {
+	Name string
+	// State is "disabled", "enabled" or "active".
+	State string
+	// ReadOnly is true if a pool with this feature active can still be
+	// imported read-only by a system that does not support it.
+	ReadOnly bool
+}
+
+// PoolSupportsFeature reports whether the feature flag feature, e.g.
+// "large_blocks" or "feature@large_blocks", is enabled or active on a
+// zpool.  A feature unknown to the zpool binary is not supported.
+func (z *ZfsH) PoolSupportsFeature(zp *Zpool, feature string) (bool, error) {
+	feature = strings.TrimPrefix(feature, "feature@")
+	out, err := z.zpoolOutput("get", "-Hp", "-o", "value", "feature@"+feature, zp.Name)
+	if err != nil {
+		if stderrContains(err, "invalid property") || stderrContains(err, "bad property") {
+			return false, nil
+		}
+		return false, err
+	}
+	state := strings.TrimSpace(out)
+	return state == "enabled" || state == "active", nil
+}
+
+// Features returns the feature flags of a zpool along with their state.
+func (z *ZfsH) Features(zp *Zpool) ([]Feature, error) {
+	out, err := z.zpool("get", "-Hp", "all", zp.Name)
+	if err != nil {
+		return nil, err
+	}
+	usage, err := z.zpoolOutput("upgrade", "-v")
+	if err != nil {
+		return nil, err
+	}
+	readOnly := parseReadOnlyFeatures(usage)
+
+	var features []Feature
+	for _, line := range out {
+		if len(line) < 3 || !strings.HasPrefix(line[1], "feature@") {
+			continue
+		}
+		name := strings.TrimPrefix(line[1], "feature@")
+		features = append(features, Feature{
+			Name:     name,
+			State:    line[2],
+			ReadOnly: readOnly[name],
+		})
+	}
+	return features, nil
+}